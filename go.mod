@@ -8,4 +8,5 @@ require (
 	github.com/aws/aws-sdk-go v1.20.7
 	github.com/cloudflare/cloudflare-go v0.9.2
 	gopkg.in/go-playground/validator.v9 v9.27.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -4,45 +4,719 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/Noah-Huppert/goconf"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	ec2Svc "github.com/aws/aws-sdk-go/service/ec2"
+	stsSvc "github.com/aws/aws-sdk-go/service/sts"
 	"github.com/cloudflare/cloudflare-go"
 	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/yaml.v2"
 )
 
+// Build information, set at build time with:
+//
+//	go build -ldflags "-X main.version=VERSION -X main.commit=COMMIT -X main.buildDate=DATE"
+var (
+	// version of the program
+	version = "dev"
+
+	// commit is the Git commit the program was built from
+	commit = "unknown"
+
+	// buildDate is when the program was built
+	buildDate = "unknown"
+)
+
+// buildInfo returns a human readable description of the build information
+func buildInfo() string {
+	return fmt.Sprintf("version=%s, commit=%s, buildDate=%s", version, commit,
+		buildDate)
+}
+
+// ManagedTagKey is the key of a tag added to the AWS resources of clusters created by
+// the program, its value is always "true"
+const ManagedTagKey = "auto-cluster/managed"
+
+// VersionTagKey is the key of a tag added to the AWS resources of clusters created by
+// the program, its value is the version of the program which created the cluster
+const VersionTagKey = "auto-cluster/version"
+
+// IgnoreTagKey is the key of an EC2 instance tag which excludes the instance's cluster
+// from being managed when its value is "true"
+const IgnoreTagKey = "auto-cluster/ignore"
+
+// ExpiresAtTagKey is the key of an EC2 instance tag whose value is an RFC 3339 time
+// after which the instance's cluster is deleted, instead of after
+// Config.Cluster.OldestAge
+const ExpiresAtTagKey = "auto-cluster/expires-at"
+
+// ClusterOwnedTagPrefix is the prefix of the key of a tag the OpenShift installer adds
+// to AWS resources it creates, followed by the cluster's infrastructure ID. Its value
+// is "owned".
+const ClusterOwnedTagPrefix = "kubernetes.io/cluster/"
+
 // loggerChild makes a log.Logger from an existing log.Logger
 func loggerChild(from *log.Logger, prefix string) *log.Logger {
 	return log.New(from.Writer(), fmt.Sprintf("%s.%s", from.Prefix(), prefix),
 		from.Flags())
 }
 
-// Config holds configuration
+// loggerTee makes a log.Logger which writes to an existing log.Logger's output and to w
+func loggerTee(from *log.Logger, w io.Writer) *log.Logger {
+	return log.New(io.MultiWriter(from.Writer(), w), from.Prefix(), from.Flags())
+}
+
+// openClusterLog opens a log file in a cluster's state directory for appending.
+// If mkdir is true the state directory is created if it does not exist. If the
+// file cannot be opened the error is logged and output is discarded. The returned
+// function closes the file.
+func openClusterLog(logger *log.Logger, cfg Config, clusterName, file string,
+	mkdir bool) (io.Writer, func()) {
+
+	dir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, clusterName)
+	path := filepath.Join(dir, file)
+
+	if mkdir {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Printf("failed to create state directory for cluster %s, not "+
+				"writing %s: %s", clusterName, path, err.Error())
+			return ioutil.Discard, func() {}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Printf("failed to open log file %s for cluster %s: %s", path,
+			clusterName, err.Error())
+		return ioutil.Discard, func() {}
+	}
+
+	return f, func() {
+		if err := f.Close(); err != nil {
+			logger.Printf("failed to close log file %s: %s", path, err.Error())
+		}
+	}
+}
+
+// configDocs explains each Config section and field, keys are section names or
+// "Section.Field". Written as comments by writeExampleConfig.
+var configDocs = map[string]string{
+	"Cluster": "Clusters which are created, deleted, and pointed to by DNS",
+	"Cluster.NamePrefix": "Prefix of the names of managed clusters, followed by a " +
+		"number. Only letters, numbers, and dashes, lowercased.",
+	"Cluster.OldestAge": "Age after which a cluster is replaced and deleted",
+	"Cluster.MaxDeletes": "Most clusters deleted in one control loop execution, " +
+		"further deletions are deferred to the next execution",
+	"Cluster.RequireManagedTag": "Only manage clusters with the " +
+		"auto-cluster/managed=true tag, so clusters not created by auto-cluster " +
+		"are never touched",
+	"Cluster.EnvironmentTag": "\"key=value\" tag added to created clusters, if set " +
+		"only clusters with the tag are managed. Separates deployments sharing an " +
+		"AWS account and NamePrefix.",
+	"Cluster.MinHealthy": "Fewest healthy clusters to keep, deleting healthy " +
+		"clusters which would leave fewer is deferred",
+	"Cluster.RequireRunning": "Only delete clusters, or make them the primary " +
+		"cluster, if all their instances are running",
+	"Cluster.MinPrimaryAge": "Youngest an existing cluster can be to become the " +
+		"primary cluster. Younger clusters are kept but never cause deletions.",
+	"Cluster.TTL": "If not 0 created clusters are tagged to expire after this " +
+		"long, instead of using OldestAge",
+	"Cluster.CreateFailureLimit": "Failed cluster creations in a row after which " +
+		"creation is paused for CreateCooldown",
+	"Cluster.CreateCooldown": "How long cluster creation is paused after " +
+		"CreateFailureLimit failures",
+	"Cluster.CreateNameRetries": "Times creating a cluster is retried with a new " +
+		"name if AWS resources with its name already exist",
+	"Cluster.DeleteCooldown": "Least time between deleting a cluster and the " +
+		"previous create or delete, spreads out AWS API requests",
+	"Cluster.DeleteAttempts": "Times deleting a cluster is attempted before " +
+		"giving up",
+	"Cluster.DeleteBackoff": "Wait after the first failed delete attempt, " +
+		"doubles after each failed attempt",
+	"Cluster.Namespace": "Namespace to migrate",
+	"Cloudflare":        "Cloudflare DNS records which point to the primary cluster",
+	"Cloudflare.Email":  "Email address of the Cloudflare account",
+	"Cloudflare.APIKey": "Cloudflare API key",
+	"Cloudflare.ZoneID": "ID of the Cloudflare zone in which records are " +
+		"configured",
+	"OpenShiftInstall": "How openshift-install creates and deletes clusters",
+	"OpenShiftInstall.StateStorePath": "Directory in which the state of each " +
+		"cluster is stored, needed to access and delete clusters",
+	"OpenShiftInstall.WorkDir": "If set clusters are created in this directory " +
+		"and only the files needed later are copied to StateStorePath",
+	"OpenShiftInstall.PullSecretPath": "Pull secret file used to create " +
+		"clusters, if empty the pull-secret file in StateStorePath is used",
+	"OpenShiftInstall.Zones": "AWS availability zones cluster machines are " +
+		"created in, if empty the installer picks",
+	"OpenShiftInstall.Subnets": "IDs of existing AWS subnets clusters are " +
+		"created in, if empty a VPC is created",
+	"OpenShiftInstall.Publish": "\"External\" publishes the API and ingress to " +
+		"the internet, \"Internal\" only to the VPC and requires Subnets",
+	"OpenShiftInstall.HTTPProxy": "URL of a proxy for HTTP requests made by " +
+		"clusters",
+	"OpenShiftInstall.HTTPSProxy": "URL of a proxy for HTTPS requests made by " +
+		"clusters",
+	"OpenShiftInstall.NoProxy": "Comma separated domains and CIDRs clusters " +
+		"reach without a proxy",
+	"OpenShiftInstall.AdditionalTrustBundlePath": "File of PEM encoded " +
+		"certificates clusters trust",
+	"OpenShiftInstall.LogLevel": "openshift-install log level",
+	"OpenShiftInstall.DestroyLogLevel": "openshift-install log level when " +
+		"deleting clusters, if empty LogLevel is used",
+	"OpenShiftInstall.UserTags": "Tags added to the AWS resources of clusters. " +
+		"Keys and values cannot contain commas, double quotes, backslashes, or " +
+		"newlines, keys cannot contain equals signs.",
+	"OpenShiftInstall.RequiredTags": "Keys which must be in UserTags, or the " +
+		"base install configuration's userTags, enforces tagging policies",
+	"OpenShiftInstall.CredentialsMode": "How cluster components get AWS " +
+		"credentials, if empty the installer decides",
+	"OpenShiftInstall.FeatureSet": "Enables features which are not on by " +
+		"default, clusters with a feature set cannot be upgraded",
+	"OpenShiftInstall.BaseInstallConfigPath": "Complete install-config.yaml " +
+		"used to create clusters, only metadata.name is changed. If set the " +
+		"other install configuration options are not used.",
+	"OpenShiftInstall.IdleTimeout": "How long openshift-install can go without " +
+		"output before it is killed as stalled, disabled if 0",
+	"OpenShiftInstall.GatherOnFailure": "Run \"openshift-install gather " +
+		"bootstrap\" when creating a cluster fails, to collect logs",
+	"OpenShiftInstall.MinFreeSpace": "Least free disk space, in gigabytes, " +
+		"StateStorePath and WorkDir need to create a cluster, disabled if 0",
+	"OpenShiftInstall.Env": "Environment variables set for openshift-install",
+	"Slack":                "Slack notifications",
+	"Slack.IncomingWebhook": "Incoming webhook of the channel new cluster " +
+		"credentials are posted to",
+	"Slack.NotifyQuotaExceeded": "Post a message when creating a cluster fails " +
+		"because an AWS quota was exceeded",
+	"Helm":       "Helm chart installed on new clusters",
+	"Helm.Chart": "URI of a Git repository with the chart in its root directory",
+	"Hooks":      "Commands run at points in a cluster's life",
+	"Hooks.PostCreate": "Command run with \"sh -c\" after a cluster is " +
+		"created",
+	"Hooks.PostCreateFailure": "If PostCreate fails, \"warn\" logs a warning " +
+		"and \"delete\" deletes the cluster",
+	"Hooks.PreDelete": "Command run with \"sh -c\" before a cluster is " +
+		"deleted",
+	"Hooks.PreDeleteFailure": "If PreDelete fails, \"abort\" does not delete " +
+		"the cluster and \"continue\" deletes it anyway",
+	"Hooks.Timeout": "Longest a hook can run before it is killed and fails",
+	"AWS":           "AWS API access",
+	"AWS.ThrottleMaxWait": "Longest time throttled AWS API calls are " +
+		"retried",
+	"AWS.MaxRetries": "Times the AWS SDK retries failed API calls, if -1 " +
+		"the SDK's default is used",
+	"AWS.MaxClockSkew": "Largest tolerated difference between the local and " +
+		"AWS clocks, larger differences use AWS's clock for cluster ages",
+	"AWS.AssumeRoleARN": "ARN of an IAM role to assume, if empty credentials " +
+		"from the environment are used",
+	"AWS.ExternalID": "External ID provided when assuming AssumeRoleARN",
+	"AWS.StartupAttempts": "Times connecting to AWS is attempted at startup " +
+		"before exiting",
+	"AWS.StartupBackoff": "Wait after the first failed attempt to connect to " +
+		"AWS at startup, doubles after each failed attempt",
+	"AWS.Endpoint": "URL of the AWS API, for testing against a local API " +
+		"like localstack. Not used by openshift-install.",
+	"Loop": "The control loop",
+	"Loop.Deadline": "Longest a control loop execution can take, actions not " +
+		"started by then are deferred. Disabled if 0.",
+	"Loop.InitialDelay": "Wait after startup before the first control loop " +
+		"execution",
+	"Loop.ContinueOnError": "Skip the control loop execution when getting " +
+		"state fails, and skip actions which fail, instead of exiting",
+	"Audit": "Audit log",
+	"Audit.LogPath": "File a JSON line is appended to for each cluster " +
+		"created or deleted, if empty no audit log is written",
+	"Status": "HTTP status server",
+	"Status.Addr": "Address the status server listens on, if empty it is " +
+		"not started",
+	"Status.StaleAge": "Longest time since the last successful control loop " +
+		"execution before /readyz reports not ready",
+	"Status.Pprof": "Serve net/http/pprof debugging endpoints",
+	"Health":       "Cluster health probes",
+	"Health.Probe": "Check the Kubernetes API and node readiness of clusters",
+	"Health.UnhealthyLimit": "Control loop executions in a row a cluster can " +
+		"fail its health probe before it is replaced",
+	"Health.ProbeTimeout": "Longest a health probe can take before it fails",
+	"Health.ConsoleCheck": "Check a cluster's web console responds over " +
+		"HTTPS before it can become the primary cluster",
+	"Health.ConsoleCheckTimeout": "Longest a console check request can take",
+	"Health.ConsoleCheckAttempts": "Times a console check is attempted " +
+		"before the cluster is considered unreachable",
+}
+
+// wrapComment splits text into TOML comment lines no longer than width, unless
+// a word is longer. Empty if text is empty.
+func wrapComment(text string, width int) []string {
+	lines := []string{}
+	line := "#"
+
+	for _, word := range strings.Fields(text) {
+		if len(line) > 1 && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = "#"
+		}
+		line += " " + word
+	}
+
+	if len(line) > 1 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// writeExampleConfig writes an example TOML configuration file generated from the
+// Config struct. Each section and field is commented with its explanation from
+// configDocs, and each field with its type, if it is required, its validation
+// rules, and if changing it requires a restart. Fields are set to their default
+// values.
+func writeExampleConfig(w io.Writer) error {
+	buf := bytes.NewBuffer([]byte{})
+	cfgType := reflect.TypeOf(Config{})
+
+	for i := 0; i < cfgType.NumField(); i++ {
+		section := cfgType.Field(i)
+
+		if i > 0 {
+			fmt.Fprint(buf, "\n")
+		}
+		for _, line := range wrapComment(configDocs[section.Name], 80) {
+			fmt.Fprintf(buf, "%s\n", line)
+		}
+		fmt.Fprintf(buf, "[%s]\n", section.Name)
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+
+			// Comment
+			comment := field.Type.String()
+			if unit, ok := field.Tag.Lookup("unit"); ok {
+				comment += fmt.Sprintf(" (%s)", unit)
+			}
+
+			rules := []string{}
+			for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+				if len(rule) > 0 && rule != "required" {
+					rules = append(rules, rule)
+				}
+			}
+
+			if strings.Contains(field.Tag.Get("validate"), "required") {
+				comment += ", required"
+			} else {
+				comment += ", optional"
+			}
+
+			if len(rules) > 0 {
+				comment += fmt.Sprintf(", must be: %s", strings.Join(rules, ","))
+			}
+
+			if field.Tag.Get("restart") == "true" {
+				comment += ", changes require a restart"
+			}
+
+			// Value
+			def, hasDef := field.Tag.Lookup("default")
+			value := ""
+
+			switch field.Type.Kind() {
+			case reflect.String:
+				value = strconv.Quote(def)
+			case reflect.Bool:
+				value = "false"
+				if hasDef {
+					value = def
+				}
+			case reflect.Float64, reflect.Int, reflect.Uint:
+				value = "0"
+				if hasDef {
+					value = def
+				}
+			case reflect.Slice:
+				value = "[]"
+			case reflect.Map:
+				value = "{}"
+			default:
+				return fmt.Errorf("unsupported type %s for field %s.%s",
+					field.Type.String(), section.Name, field.Name)
+			}
+
+			for _, line := range wrapComment(configDocs[section.Name+"."+field.Name], 80) {
+				fmt.Fprintf(buf, "%s\n", line)
+			}
+			fmt.Fprintf(buf, "# %s\n%s = %s\n", comment, field.Name, value)
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// durationUnits are the units which can be used in the unit tag of Config fields
+var durationUnits = map[string]time.Duration{
+	"hours":   time.Hour,
+	"minutes": time.Minute,
+	"seconds": time.Second,
+}
+
+// writeEffectiveConfig writes cfg as YAML, with the values of fields tagged
+// redact:"true", Config.OpenShiftInstall.Env values, and passwords in URLs
+// redacted. Fields with a unit tag are also written as durations.
+func writeEffectiveConfig(w io.Writer, cfg Config) error {
+	doc := yaml.MapSlice{}
+	cfgValue := reflect.ValueOf(cfg)
+	cfgType := cfgValue.Type()
+
+	for i := 0; i < cfgType.NumField(); i++ {
+		section := cfgType.Field(i)
+		sectionValue := cfgValue.Field(i)
+		fields := yaml.MapSlice{}
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			var value interface{} = sectionValue.Field(j).Interface()
+
+			if field.Tag.Get("redact") == "true" {
+				value = "REDACTED"
+			} else if str, ok := value.(string); ok {
+				value = urlUserInfoExp.ReplaceAllString(str, "://REDACTED@")
+			} else if env, ok := value.(map[string]string); ok {
+				redacted := map[string]string{}
+				for key := range env {
+					redacted[key] = "REDACTED"
+				}
+				value = redacted
+			}
+
+			fields = append(fields, yaml.MapItem{Key: field.Name, Value: value})
+
+			if unit, ok := field.Tag.Lookup("unit"); ok {
+				num, ok := value.(float64)
+				if !ok {
+					return fmt.Errorf("unit tag on non float64 field %s.%s",
+						section.Name, field.Name)
+				}
+
+				fields = append(fields, yaml.MapItem{
+					Key:   field.Name + "Duration",
+					Value: time.Duration(num * float64(durationUnits[unit])).String(),
+				})
+			}
+		}
+
+		doc = append(doc, yaml.MapItem{Key: section.Name, Value: fields})
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration as YAML: %s", err.Error())
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+// cfgPaths are globs which match configuration files
+var cfgPaths = []string{"/etc/auto-cluster/*.toml", "./*.toml"}
+
+// cfgFiles returns a human readable list of the configuration files matched by
+// cfgPaths
+func cfgFiles() string {
+	files := []string{}
+	for _, p := range cfgPaths {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, matches...)
+	}
+
+	if len(files) == 0 {
+		return fmt.Sprintf("no files matching %s", strings.Join(cfgPaths, ", "))
+	}
+
+	return strings.Join(files, ", ")
+}
+
+// LogEvent is a machine readable record of a control loop lifecycle event
+type LogEvent struct {
+	// Time event occurred
+	Time time.Time `json:"time"`
+
+	// Event type, one of: log, loop_start, loop_end, create, delete, error
+	Event string `json:"event"`
+
+	// LoopID is the ID of the control loop execution during which the event occurred
+	LoopID string `json:"loop_id,omitempty"`
+
+	// Cluster the event concerns, if any
+	Cluster string `json:"cluster,omitempty"`
+
+	// Action the event concerns, if any, one of: create, delete, helm_install, dns_set
+	Action string `json:"action,omitempty"`
+
+	// Duration of the action or control loop, in seconds
+	Duration float64 `json:"duration_seconds,omitempty"`
+
+	// Error message if Event is error
+	Error string `json:"error,omitempty"`
+
+	// Message is a human readable description of the event
+	Message string `json:"message,omitempty"`
+}
+
+// String representation of LogEvent
+func (e LogEvent) String() string {
+	str := fmt.Sprintf("event=%s", e.Event)
+
+	if len(e.LoopID) > 0 {
+		str += fmt.Sprintf(", loop_id=%s", e.LoopID)
+	}
+
+	if len(e.Cluster) > 0 {
+		str += fmt.Sprintf(", cluster=%s", e.Cluster)
+	}
+
+	if len(e.Action) > 0 {
+		str += fmt.Sprintf(", action=%s", e.Action)
+	}
+
+	if e.Duration > 0 {
+		str += fmt.Sprintf(", duration=%.0fs", e.Duration)
+	}
+
+	if len(e.Error) > 0 {
+		str += fmt.Sprintf(", error=%s", e.Error)
+	}
+
+	if len(e.Message) > 0 {
+		str += fmt.Sprintf(", message=%s", e.Message)
+	}
+
+	return str
+}
+
+// JSONLogWriter is an io.Writer for log.Logger which writes each log message as a
+// JSON encoded LogEvent line
+type JSONLogWriter struct {
+	// out is where JSON lines are written
+	out io.Writer
+
+	// mutex ensures JSON lines from multiple loggers are not interleaved
+	mutex sync.Mutex
+}
+
+// NewJSONLogWriter creates a JSONLogWriter
+func NewJSONLogWriter(out io.Writer) *JSONLogWriter {
+	return &JSONLogWriter{
+		out: out,
+	}
+}
+
+// Write a log message as a LogEvent with the log event type
+func (w *JSONLogWriter) Write(p []byte) (int, error) {
+	err := w.WriteEvent(LogEvent{
+		Time:    time.Now(),
+		Event:   "log",
+		Message: strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// WriteEvent writes a LogEvent as a JSON line
+func (w *JSONLogWriter) WriteEvent(event LogEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode log event as JSON: %s", err.Error())
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.out.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("failed to write log event: %s", err.Error())
+	}
+
+	return nil
+}
+
+// AuditRecord is a record of a cluster being created or deleted. It must never
+// hold secrets.
+type AuditRecord struct {
+	// Time the action finished
+	Time time.Time `json:"time"`
+
+	// Version of the program which performed the action
+	Version string `json:"version"`
+
+	// LoopID is the ID of the control loop execution which performed the action
+	LoopID string `json:"loop_id"`
+
+	// Action performed, either create or delete
+	Action string `json:"action"`
+
+	// Cluster name
+	Cluster string `json:"cluster"`
+
+	// InfraID is the infrastructure ID of the cluster, empty if unknown
+	InfraID string `json:"infra_id"`
+
+	// Outcome of the action, either completed or failed
+	Outcome string `json:"outcome"`
+}
+
+// appendAuditRecord appends an AuditRecord as a JSON line to the audit log file
+// at path, the file is created if it does not exist
+func appendAuditRecord(path string, record AuditRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record as JSON: %s", err.Error())
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err.Error())
+	}
+
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit record: %s", err.Error())
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync audit log: %s", err.Error())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %s", err.Error())
+	}
+
+	return nil
+}
+
+// logEvent logs a lifecycle event. If logger writes JSON the event is written as is,
+// otherwise it is written as a human readable log line.
+func logEvent(logger *log.Logger, event LogEvent) {
+	event.Time = time.Now()
+
+	if w, ok := logger.Writer().(*JSONLogWriter); ok {
+		if err := w.WriteEvent(event); err != nil {
+			logger.Printf("failed to log event: %s", err.Error())
+		}
+		return
+	}
+
+	logger.Print(event.String())
+}
+
+// Config holds configuration. Fields tagged restart:"true" are only used at
+// startup, changing them requires a restart.
 type Config struct {
 	// Cluster configuration
 	Cluster struct {
 		// NamePrefix is the prefix to add to cluster names.
-		// This value must only contain alphanumeric characters and dashes.
+		// This value must only contain alphanumeric characters and dashes. It is
+		// lowercased by normalizeConfig, since cluster names must be lowercase.
 		NamePrefix string `validate:"required,alphadash"`
 
 		// OldestAge a cluster can be before being deleted, in hours
-		OldestAge float64 `validate:"min=0,max=48" default:"42"`
+		OldestAge float64 `validate:"min=0,max=48" default:"42" unit:"hours"`
+
+		// MaxDeletes is the most clusters which will be deleted in one control loop
+		// execution, further deletions are deferred to the next execution
+		MaxDeletes uint `validate:"min=1" default:"3"`
+
+		// RequireManagedTag indicates only clusters with the ManagedTagKey tag will be
+		// managed. This prevents managing clusters not created by this program.
+		RequireManagedTag bool
+
+		// EnvironmentTag is a "key=value" tag added to the AWS resources of
+		// created clusters. If set only clusters with the tag are managed, which
+		// separates instances of this program sharing an AWS account and prefix.
+		EnvironmentTag string
+
+		// MinHealthy is the fewest healthy clusters there can be, deleting healthy
+		// clusters which would leave fewer is deferred. Clusters are healthy if
+		// they pass their health probe, or if Config.Health.Probe is false, have
+		// running instances. Only managed clusters are counted.
+		MinHealthy uint
+
+		// RequireRunning indicates clusters will only be deleted or made the primary
+		// cluster if all their instances are running. Clusters with pending,
+		// stopping, or stopped instances are left alone.
+		RequireRunning bool
+
+		// MinPrimaryAge is the youngest an existing cluster can be before it can
+		// become the primary cluster, in hours. Clusters created by the current
+		// control loop execution are exempt. Younger clusters are kept and count
+		// toward MinHealthy, but never cause other clusters to be deleted.
+		MinPrimaryAge float64 `validate:"min=0,max=48" unit:"hours"`
+
+		// TTL is how long clusters created by the program live, in hours. If not 0
+		// clusters are created with the ExpiresAtTagKey tag, which is used instead
+		// of OldestAge.
+		TTL float64 `validate:"min=0" unit:"hours"`
+
+		// CreateFailureLimit is the number of times in a row creating a cluster can
+		// fail before cluster creation is paused for CreateCooldown
+		CreateFailureLimit uint `validate:"min=1" default:"3"`
+
+		// CreateCooldown is how long cluster creation is paused after
+		// CreateFailureLimit failures, in hours
+		CreateCooldown float64 `validate:"min=0" default:"2" unit:"hours"`
+
+		// CreateNameRetries is the number of times creating a cluster is retried with
+		// a new name, in the same control loop execution, if it fails because AWS
+		// resources with the cluster's name already exist
+		CreateNameRetries uint `default:"2"`
+
+		// DeleteCooldown is the least time between deleting a cluster and the
+		// previous create or delete in the same control loop execution, in seconds.
+		// Spreads out AWS API requests.
+		DeleteCooldown float64 `validate:"min=0" unit:"seconds"`
+
+		// DeleteAttempts is the number of times deleting a cluster is attempted
+		// before giving up
+		DeleteAttempts uint `validate:"min=1" default:"3"`
+
+		// DeleteBackoff is the time to wait after the first failed attempt to delete
+		// a cluster, in seconds. Doubles after each failed attempt.
+		DeleteBackoff float64 `validate:"min=0" default:"60" unit:"seconds"`
 
 		// Namespace to migrate
 		Namespace string `validate:"required"`
@@ -54,7 +728,7 @@ type Config struct {
 		Email string `validate:"required"`
 
 		// APIKey
-		APIKey string `validate:"required"`
+		APIKey string `validate:"required" redact:"true"`
 
 		// ZoneID is the ID of the zone on Cloudflare to configure
 		ZoneID string `validate:"required"`
@@ -64,12 +738,102 @@ type Config struct {
 	OpenShiftInstall struct {
 		// StateStorePath is the directory openshift-install state is stored
 		StateStorePath string `validate:"required"`
+
+		// WorkDir is the directory in which openshift-install creates clusters, if
+		// set. Only the files needed to access and delete clusters are copied to
+		// StateStorePath, the rest are removed after creating. If empty clusters
+		// are created in StateStorePath.
+		WorkDir string
+
+		// PullSecretPath is the path to the pull secret file used to create
+		// clusters. If empty the pull-secret file in StateStorePath is used.
+		PullSecretPath string
+
+		// Zones are the AWS availability zones cluster machines will be created in.
+		// If empty the installer picks zones.
+		Zones []string
+
+		// Subnets are the IDs of existing AWS subnets clusters will be created in,
+		// instead of creating a VPC. If empty a VPC is created.
+		Subnets []string
+
+		// Publish is how the cluster's API and ingress are published: "External" to
+		// the internet, or "Internal" only to the VPC. Internal requires Subnets.
+		Publish string `validate:"oneof=External Internal" default:"External"`
+
+		// HTTPProxy is the URL of a proxy for HTTP requests made by clusters, optional
+		HTTPProxy string `validate:"omitempty,url"`
+
+		// HTTPSProxy is the URL of a proxy for HTTPS requests made by clusters, optional
+		HTTPSProxy string `validate:"omitempty,url"`
+
+		// NoProxy is a comma separated list of domains and CIDRs for which clusters
+		// will not use a proxy, optional
+		NoProxy string
+
+		// AdditionalTrustBundlePath is the path to a file with PEM encoded
+		// certificates which clusters will trust, optional
+		AdditionalTrustBundlePath string
+
+		// LogLevel is the openshift-install log level, one of: debug, info, warn,
+		// error
+		LogLevel string `validate:"oneof=debug info warn error" default:"info"`
+
+		// DestroyLogLevel is the log level of openshift-install when deleting
+		// clusters, one of: debug, info, warn, error. If empty LogLevel is used.
+		DestroyLogLevel string `validate:"omitempty,oneof=debug info warn error"`
+
+		// UserTags are added to the AWS resources of clusters, in addition to the
+		// tags the program adds. Keys and values cannot contain commas, keys cannot
+		// contain equals signs.
+		UserTags map[string]string
+
+		// RequiredTags are keys which must be in UserTags, or in the base
+		// openshift-install configuration file's platform.aws.userTags if
+		// BaseInstallConfigPath is set. Enforces tagging policies.
+		RequiredTags []string
+
+		// CredentialsMode is how clusters get AWS credentials for their components,
+		// one of: Mint, Passthrough, Manual. If empty the installer decides.
+		CredentialsMode string `validate:"omitempty,oneof=Mint Passthrough Manual"`
+
+		// FeatureSet enables a set of features which are not enabled by default,
+		// TechPreviewNoUpgrade is the only value supported. Clusters with a feature
+		// set cannot be upgraded. Optional.
+		FeatureSet string `validate:"omitempty,oneof=TechPreviewNoUpgrade"`
+
+		// BaseInstallConfigPath is the path to a complete openshift-install
+		// configuration file used to create clusters, only its metadata.name is
+		// changed. If set the other options which configure the openshift-install
+		// configuration file are not used. Optional.
+		BaseInstallConfigPath string
+
+		// IdleTimeout is how long openshift-install can go without outputting a line
+		// before it is considered stalled and killed, in minutes. Disabled if 0.
+		IdleTimeout float64 `validate:"min=0" unit:"minutes"`
+
+		// GatherOnFailure indicates "openshift-install gather bootstrap" is run when
+		// creating a cluster fails, to collect logs in the cluster's state directory
+		GatherOnFailure bool
+
+		// MinFreeSpace is the least free disk space, in gigabytes, StateStorePath
+		// and WorkDir must have for a cluster to be created. openshift-install
+		// leaves a cluster's resources behind if it runs out of space. Disabled if 0.
+		MinFreeSpace float64 `validate:"min=0" default:"2"`
+
+		// Env are environment variables to set for openshift-install, on top of the
+		// program's environment. Keys must be valid environment variable names.
+		Env map[string]string
 	} `validate:"required"`
 
 	// Slack configuration
 	Slack struct {
 		// IncomingWebhook is a Slack API incoming webhook to a channel where the new cluster's credentials will be placed
-		IncomingWebhook string `validate:"required"`
+		IncomingWebhook string `validate:"required" redact:"true"`
+
+		// NotifyQuotaExceeded indicates a message is posted to IncomingWebhook when
+		// creating a cluster fails because an AWS quota was exceeded
+		NotifyQuotaExceeded bool
 	} `validate:"required"`
 
 	// Helm configures a Helm chart to be installed on new clusters
@@ -77,6 +841,134 @@ type Config struct {
 		// Chart is the URI of a Git repository which holds the chart to install in its root directory
 		Chart string
 	}
+
+	// Hooks are commands run at points in a cluster's life
+	Hooks struct {
+		// PostCreate is a command run with "sh -c" after a cluster is created,
+		// optional. See hookEnv for its environment variables.
+		PostCreate string
+
+		// PostCreateFailure is what happens if PostCreate fails, either "warn" to
+		// log a warning or "delete" to delete the cluster
+		PostCreateFailure string `validate:"oneof=warn delete" default:"warn"`
+
+		// PreDelete is a command run with "sh -c" before a cluster is deleted,
+		// optional. See hookEnv for its environment variables.
+		PreDelete string
+
+		// PreDeleteFailure is what happens if PreDelete fails, either "abort" to
+		// not delete the cluster or "continue" to delete it anyway
+		PreDeleteFailure string `validate:"oneof=abort continue" default:"abort"`
+
+		// Timeout is the longest a hook can run before it is killed and considered
+		// failed, in minutes
+		Timeout float64 `validate:"min=0" default:"10" unit:"minutes"`
+	}
+
+	// AWS API configuration
+	AWS struct {
+		// ThrottleMaxWait is the longest time to retry AWS API calls which are being
+		// throttled, in seconds
+		ThrottleMaxWait float64 `validate:"min=0" default:"120" unit:"seconds"`
+
+		// MaxRetries is the number of times the AWS SDK retries failed API calls,
+		// before ThrottleMaxWait and StartupAttempts retries. If -1 the SDK's
+		// default for each service is used.
+		MaxRetries int `validate:"min=-1" default:"-1" restart:"true"`
+
+		// MaxClockSkew is the largest difference between the local clock and AWS's
+		// clock which is tolerated, in seconds. If the difference is larger a
+		// warning is logged and cluster ages are calculated using AWS's clock.
+		MaxClockSkew float64 `validate:"min=1" default:"60" unit:"seconds" restart:"true"`
+
+		// AssumeRoleARN is the ARN of an IAM role to assume using STS. If empty
+		// the credentials from the environment are used directly.
+		AssumeRoleARN string `restart:"true"`
+
+		// ExternalID to provide when assuming AssumeRoleARN, optional
+		ExternalID string `restart:"true"`
+
+		// StartupAttempts is the number of times connecting to AWS is attempted at
+		// startup before exiting
+		StartupAttempts uint `validate:"min=1" default:"5" restart:"true"`
+
+		// StartupBackoff is the time to wait after the first failed attempt to
+		// connect to AWS at startup, in seconds. Doubles after each failed attempt.
+		StartupBackoff float64 `validate:"min=0" default:"5" unit:"seconds" restart:"true"`
+
+		// Endpoint overrides the URL of the AWS API used by the program, for
+		// testing against a local AWS API like localstack. If empty the real AWS
+		// API is used. Not used by openshift-install.
+		Endpoint string `validate:"omitempty,url" restart:"true"`
+	}
+
+	// Loop configures the control loop
+	Loop struct {
+		// Deadline is the longest a control loop execution can take, in minutes.
+		// Actions not started by the deadline are deferred to the next execution,
+		// actions which have started are not interrupted. Disabled if 0.
+		Deadline float64 `validate:"min=0" unit:"minutes"`
+
+		// InitialDelay is how long to wait after startup before the first control
+		// loop execution, in seconds. Gives sidecars and monitoring time to start.
+		// Not used with Flags.Once.
+		InitialDelay float64 `validate:"min=0" unit:"seconds" restart:"true"`
+
+		// ContinueOnError indicates failures to get clusters or DNS records from
+		// the AWS or Cloudflare APIs skip the control loop execution instead of
+		// exiting. Failures of actions on one cluster, ex., deleting it, are logged
+		// and the rest of the plan which does not depend on the action is still
+		// executed. The next execution is run as usual. Not used with Flags.Once.
+		ContinueOnError bool
+	}
+
+	// Audit configures the audit log
+	Audit struct {
+		// LogPath is the file to which a JSON line is appended for each cluster
+		// created or deleted. The file is never truncated or rotated. If empty no
+		// audit log is written.
+		LogPath string
+	}
+
+	// Status configures the HTTP status server
+	Status struct {
+		// Addr is the address the status server listens on, if empty the status
+		// server is not started
+		Addr string `restart:"true"`
+
+		// StaleAge is the longest time since the last successful control loop
+		// execution before the status server reports not ready, in minutes
+		StaleAge float64 `validate:"min=0" default:"90" unit:"minutes" restart:"true"`
+
+		// Pprof enables net/http/pprof debugging endpoints on the status server
+		Pprof bool `restart:"true"`
+	}
+
+	// Health configures cluster health probes
+	Health struct {
+		// Probe enables checking the Kubernetes API and node readiness of clusters
+		Probe bool
+
+		// UnhealthyLimit is the number of consecutive control loop executions a cluster
+		// can fail its health probe before it is replaced
+		UnhealthyLimit uint `validate:"min=1" default:"3"`
+
+		// ProbeTimeout is the longest a cluster's health probe can take, in minutes.
+		// Probes which take longer fail.
+		ProbeTimeout float64 `validate:"min=0" default:"5" unit:"minutes"`
+
+		// ConsoleCheck enables checking a cluster's web console responds over HTTPS
+		// before it can become the primary cluster
+		ConsoleCheck bool
+
+		// ConsoleCheckTimeout is the longest a console check request can take, in
+		// seconds
+		ConsoleCheckTimeout float64 `validate:"min=0" default:"10" unit:"seconds"`
+
+		// ConsoleCheckAttempts is the number of times a console check is attempted
+		// before the cluster is considered unreachable
+		ConsoleCheckAttempts uint `validate:"min=1" default:"3"`
+	}
 }
 
 // Flags provided by command line invocation
@@ -90,6 +982,74 @@ type Flags struct {
 
 	// NoDNS indicates the control loop should not modify DNS records
 	NoDNS bool
+
+	// LogFormat is the format of log output, either "text" or "json"
+	LogFormat string
+
+	// ReapOrphans indicates clusters created by this program which no longer match
+	// Config.Cluster.NamePrefix should be deleted
+	ReapOrphans bool
+
+	// DetectDrift indicates the control loop should run once without executing
+	// plans, and the program should exit with status 1 if clusters would be
+	// created or deleted. Implies Once and DryRun.
+	DetectDrift bool
+
+	// ExplainPrimary indicates the control loop should run once without executing
+	// plans, and why each cluster is or is not the primary cluster should be
+	// printed to stdout. Implies Once and DryRun.
+	ExplainPrimary bool
+
+	// MetricsSnapshot indicates the control loop should run once without
+	// executing plans, and metrics should be written to stdout in the OpenMetrics
+	// text format. Implies Once and DryRun.
+	MetricsSnapshot bool
+
+	// RotatePrimary indicates the control loop should run once, creating a new
+	// primary cluster and then deleting the current clusters. Implies Once.
+	RotatePrimary bool
+
+	// SkipPreflight indicates required programs should not be checked for at startup
+	SkipPreflight bool
+
+	// Version indicates build information should be printed and then the program
+	// should exit
+	Version bool
+
+	// Output is the format in which found clusters and plans are written to
+	// stdout, either empty for none or "yaml". When set log messages are written
+	// to stderr.
+	Output string
+
+	// ValidateTemplate indicates the openshift-install configuration file for the
+	// next cluster should be rendered, checked, and printed to stdout with
+	// secrets redacted, and then the program should exit. AWS is not used.
+	ValidateTemplate bool
+
+	// ShowCredentials indicates kubeadmin passwords should not be redacted in
+	// Output
+	ShowCredentials bool
+
+	// PrintConfig indicates the loaded configuration should be printed, with
+	// secrets redacted, and then the program should exit
+	PrintConfig bool
+
+	// Import is the openshift-install state directory of a cluster which was not
+	// created by this program. If not empty the cluster is put under management
+	// and then the program exits.
+	Import string
+
+	// PrintExampleConfig indicates an example configuration file should be printed
+	// and then the program should exit
+	PrintExampleConfig bool
+
+	// Annotate is the name of a cluster to which the key=value annotations in
+	// the command line arguments are added. If not empty the program exits after.
+	Annotate string
+
+	// Unannotate is the name of a cluster from which the annotation keys in the
+	// command line arguments are removed. If not empty the program exits after.
+	Unannotate string
 }
 
 // Cluster is the state of a cluster
@@ -103,27 +1063,102 @@ type Cluster struct {
 	// DNSPointed indicates if the Cloudflare DNS zone is pointing to the AWS Route53 zone
 	// for the cluster
 	DNSPointed bool
-}
 
-// String representation of Cluster
-func (c Cluster) String() string {
-	return fmt.Sprintf("Name=%s, Age=%s, DNSPointed=%t",
-		c.Name, c.Age.String(), c.DNSPointed)
-}
+	// Healthy indicates if the cluster's Kubernetes API is reachable and all its nodes
+	// are ready. Always true if Config.Health.Probe is false.
+	Healthy bool
 
-// EC2Instance holds relevant EC2 instance information
-type EC2Instance struct {
+	// Ignored indicates if any of the cluster's instances have the IgnoreTagKey tag.
+	// Ignored clusters are never deleted or used as the primary cluster.
+	Ignored bool
+
+	// InfraID is the infrastructure ID openshift-install used in the names of the
+	// cluster's AWS resources. Empty if unknown.
+	InfraID string
+
+	// ExpiresAt is when the cluster should be deleted, from the ExpiresAtTagKey
+	// tag. Zero if the cluster does not have the tag.
+	ExpiresAt time.Time
+
+	// Running indicates if all of the cluster's instances are running
+	Running bool
+
+	// ConsoleReachable indicates if the cluster's web console responded over HTTPS.
+	// Always true if Config.Health.ConsoleCheck is false.
+	ConsoleReachable bool
+}
+
+// formatTime formats t as an RFC 3339 time, empty if t is zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// Expired returns true if the cluster should be deleted at now. If ExpiresAt is
+// set it is used, otherwise the cluster expires when it is older than oldestAge
+// hours.
+func (c Cluster) Expired(oldestAge float64, now time.Time) bool {
+	if !c.ExpiresAt.IsZero() {
+		return now.After(c.ExpiresAt)
+	}
+
+	return c.Age.Hours() > oldestAge
+}
+
+// String representation of Cluster
+func (c Cluster) String() string {
+	return fmt.Sprintf("Name=%s, Age=%s, DNSPointed=%t, Healthy=%t, Ignored=%t, "+
+		"InfraID=%s, ExpiresAt=%s, Running=%t, ConsoleReachable=%t", c.Name,
+		c.Age.String(), c.DNSPointed, c.Healthy, c.Ignored, c.InfraID,
+		formatTime(c.ExpiresAt), c.Running, c.ConsoleReachable)
+}
+
+// MarshalYAML returns a YAML representation of Cluster
+func (c Cluster) MarshalYAML() (interface{}, error) {
+	return yaml.MapSlice{
+		{Key: "name", Value: c.Name},
+		{Key: "age", Value: c.Age.String()},
+		{Key: "dnsPointed", Value: c.DNSPointed},
+		{Key: "healthy", Value: c.Healthy},
+		{Key: "ignored", Value: c.Ignored},
+		{Key: "infraID", Value: c.InfraID},
+		{Key: "expiresAt", Value: formatTime(c.ExpiresAt)},
+		{Key: "running", Value: c.Running},
+		{Key: "consoleReachable", Value: c.ConsoleReachable},
+	}, nil
+}
+
+// EC2Instance holds relevant EC2 instance information
+type EC2Instance struct {
 	// Name tag
 	Name string
 
 	// CreatedOn
 	CreatedOn time.Time
+
+	// Ignored indicates if the instance has the IgnoreTagKey tag set to "true"
+	Ignored bool
+
+	// InfraID is the infrastructure ID of the instance's cluster, from the
+	// ClusterOwnedTagPrefix tag. Empty if the instance does not have the tag.
+	InfraID string
+
+	// ExpiresAt is the value of the ExpiresAtTagKey tag, zero if the instance
+	// does not have the tag
+	ExpiresAt time.Time
+
+	// Running indicates if the instance is in the running state
+	Running bool
 }
 
 // String representation of EC2Instance
 func (i EC2Instance) String() string {
-	return fmt.Sprintf("Name=%s, CreatedOn=%s",
-		i.Name, i.CreatedOn.String())
+	return fmt.Sprintf("Name=%s, CreatedOn=%s, Ignored=%t, InfraID=%s, ExpiresAt=%s, "+
+		"Running=%t", i.Name, i.CreatedOn.String(), i.Ignored, i.InfraID,
+		formatTime(i.ExpiresAt), i.Running)
 }
 
 // CFDNSRecord holds relevant Cloudflare CNAME DNS record information
@@ -150,6 +1185,24 @@ type OSInstallPlan struct {
 	Delete []Cluster
 }
 
+// uniqueClusters returns clusters without clusters which have the same name as an
+// earlier cluster, order is preserved
+func uniqueClusters(clusters []Cluster) []Cluster {
+	seen := map[string]bool{}
+	unique := []Cluster{}
+
+	for _, cluster := range clusters {
+		if seen[cluster.Name] {
+			continue
+		}
+
+		seen[cluster.Name] = true
+		unique = append(unique, cluster)
+	}
+
+	return unique
+}
+
 // String representation of OSInstallPlan
 func (p OSInstallPlan) String() string {
 	createNames := []string{}
@@ -167,6 +1220,386 @@ func (p OSInstallPlan) String() string {
 		strings.Join(deleteNames, ","))
 }
 
+// MarshalYAML returns a YAML representation of OSInstallPlan
+func (p OSInstallPlan) MarshalYAML() (interface{}, error) {
+	createNames := []string{}
+	for _, cluster := range p.Create {
+		createNames = append(createNames, cluster.Name)
+	}
+
+	deleteNames := []string{}
+	for _, cluster := range p.Delete {
+		deleteNames = append(deleteNames, cluster.Name)
+	}
+
+	return yaml.MapSlice{
+		{Key: "create", Value: createNames},
+		{Key: "delete", Value: deleteNames},
+	}, nil
+}
+
+// PlanState is the state, besides clusters and orphans, planClusters plans from
+type PlanState struct {
+	// Logger logs planning decisions
+	Logger *log.Logger
+
+	// Instanceless are clusters with a state directory but no instances, from
+	// findInstancelessClusters, keys are cluster names
+	Instanceless map[string]Cluster
+
+	// UnhealthyCounts are the number of control loop executions in a row each
+	// cluster failed its health probe, keys are cluster names
+	UnhealthyCounts map[string]uint
+
+	// RecordsCluster is the name of the cluster DNS records point to, empty if
+	// they point to more than one
+	RecordsCluster string
+
+	// RotatePrimary indicates Flags.RotatePrimary was passed
+	RotatePrimary bool
+
+	// NextName returns the name of the cluster to create, only called if a
+	// cluster could be created
+	NextName func() (string, error)
+
+	// CreatePaused indicates cluster creation is paused by the CreateBreaker,
+	// after CreateFailures failures in a row
+	CreatePaused   bool
+	CreateFailures uint
+
+	// FreeSpaceErr is not nil if there is not enough free disk space to create a
+	// cluster
+	FreeSpaceErr error
+}
+
+// planClusters plans which clusters to create and delete, and picks the primary
+// cluster, nil if no cluster can be primary. now is used to determine if clusters
+// expired. Also returns why each cluster is or is not the primary cluster, keys
+// are cluster names. Returns an error if the name of a new cluster cannot be
+// determined.
+func planClusters(clusters, orphans map[string]Cluster, cfg Config, now time.Time,
+	state PlanState) (OSInstallPlan, *Cluster, map[string]string, error) {
+
+	logger := state.Logger
+
+	osInstallPlan := OSInstallPlan{
+		Delete: []Cluster{},
+		Create: []Cluster{},
+	}
+
+	// youngClusters is a list of clusters which are less than
+	// Config.Cluster.OldestAge hours old
+	youngClusters := []Cluster{}
+
+	// primaryCluster is the cluster, existing or to be created, which
+	// will be used to host the site. This means developers will access this
+	// cluster via oc and end users will access this cluster via a domain.
+	var primaryCluster *Cluster = nil
+
+	// primaryReasons explain why each cluster is or is not the primary
+	// cluster, keys are cluster names
+	primaryReasons := map[string]string{}
+
+	// Group clusters as old (older than cfg.Cluster.OldestAge) or young. Map
+	// iteration order is random, so clusters are visited by name to make the
+	// plan the same for the same state.
+	names := []string{}
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cluster := clusters[name]
+
+		// Leave ignored clusters alone
+		if cluster.Ignored {
+			logger.Printf("ignoring cluster %s, has %s=true tag",
+				cluster.Name, IgnoreTagKey)
+			primaryReasons[cluster.Name] = fmt.Sprintf("not primary, has "+
+				"%s=true tag", IgnoreTagKey)
+			continue
+		}
+
+		// Leave clusters which are not fully running alone
+		if cfg.Cluster.RequireRunning && !cluster.Running {
+			logger.Printf("ignoring cluster %s, not all of its instances are "+
+				"running and Cluster.RequireRunning is true", cluster.Name)
+			primaryReasons[cluster.Name] = "not primary, not all instances " +
+				"running and Cluster.RequireRunning is true"
+			continue
+		}
+
+		// Plan to delete old or expired clusters
+		if cluster.Expired(cfg.Cluster.OldestAge, now) {
+			osInstallPlan.Delete = append(osInstallPlan.Delete,
+				cluster)
+
+			if !cluster.ExpiresAt.IsZero() {
+				primaryReasons[cluster.Name] = fmt.Sprintf("not primary, past "+
+					"%s tag time %s, will delete", ExpiresAtTagKey,
+					formatTime(cluster.ExpiresAt))
+			} else {
+				primaryReasons[cluster.Name] = fmt.Sprintf("not primary, older "+
+					"than Cluster.OldestAge=%.1f hours, will delete",
+					cfg.Cluster.OldestAge)
+			}
+		} else if state.UnhealthyCounts[cluster.Name] >= cfg.Health.UnhealthyLimit {
+			// Plan to replace persistently unhealthy clusters
+			logger.Printf("cluster %s has been unhealthy for %d control loop "+
+				"executions, will replace", cluster.Name,
+				state.UnhealthyCounts[cluster.Name])
+			osInstallPlan.Delete = append(osInstallPlan.Delete,
+				cluster)
+			primaryReasons[cluster.Name] = fmt.Sprintf("not primary, failed "+
+				"health probe %d times in a row, will replace",
+				state.UnhealthyCounts[cluster.Name])
+		} else {
+			youngClusters = append(youngClusters, cluster)
+		}
+	}
+
+	// Figure out what to do with young clusters
+	// If no young clusters, or rotating the primary, we have to create a new one
+	if len(youngClusters) == 0 || state.RotatePrimary {
+		// Get next cluster name
+		nextName, err := state.NextName()
+		if err != nil {
+			return OSInstallPlan{}, nil, nil, err
+		}
+
+		// Plan to create new cluster
+		c := Cluster{
+			Name: nextName,
+		}
+
+		if state.CreatePaused {
+			logger.Printf("WARNING: not creating cluster %s, creating a cluster "+
+				"failed %d times in a row, cluster creation is paused for %.1f "+
+				"hours", c.Name, state.CreateFailures,
+				cfg.Cluster.CreateCooldown)
+			primaryReasons[c.Name] = "not primary, would be created but " +
+				"cluster creation is paused after repeated failures"
+		} else if state.FreeSpaceErr != nil {
+			logger.Printf("WARNING: not creating cluster %s, not enough free "+
+				"disk space: %s", c.Name, state.FreeSpaceErr.Error())
+			primaryReasons[c.Name] = "not primary, would be created but " +
+				"there is not enough free disk space"
+		} else {
+			osInstallPlan.Create = []Cluster{c}
+			primaryCluster = &c
+			primaryReasons[c.Name] = "primary, no young cluster can be used so " +
+				"it will be created"
+			if state.RotatePrimary {
+				primaryReasons[c.Name] = "primary, -rotate-primary passed so it " +
+					"will be created"
+			}
+
+			// Plan to delete young clusters if rotating primary
+			// Deletes run after the new cluster is created, and not at all if
+			// creating it fails
+			if state.RotatePrimary {
+				logger.Printf("rotating primary, will replace clusters with %s",
+					c.Name)
+				osInstallPlan.Delete = append(osInstallPlan.Delete,
+					youngClusters...)
+
+				for _, cluster := range youngClusters {
+					primaryReasons[cluster.Name] = fmt.Sprintf("not primary, "+
+						"-rotate-primary passed, will replace with %s", c.Name)
+				}
+			}
+		}
+
+	} else { // Young clusters exist, keep the youngest and delete the rest
+		// Find youngest cluster which can be primary, preferring healthy clusters.
+		// Clusters too young to be primary are skipped, so they never cause
+		// other clusters to be deleted.
+		for i, cluster := range youngClusters {
+			if cluster.Age.Hours() < cfg.Cluster.MinPrimaryAge ||
+				!cluster.ConsoleReachable {
+				continue
+			}
+
+			if primaryCluster == nil ||
+				(cluster.Healthy && !primaryCluster.Healthy) ||
+				(cluster.Healthy == primaryCluster.Healthy &&
+					cluster.Age < primaryCluster.Age) {
+				primaryCluster = &youngClusters[i]
+			}
+		}
+
+		// Plan to delete all but youngest cluster
+		for _, cluster := range youngClusters {
+			if primaryCluster != nil && cluster.Name == primaryCluster.Name {
+				primaryReasons[cluster.Name] = "primary, youngest cluster which " +
+					"can be primary, preferring healthy clusters"
+				continue
+			}
+
+			// Keep clusters too young to be primary, they will become
+			// primary once old enough
+			if cluster.Age.Hours() < cfg.Cluster.MinPrimaryAge {
+				logger.Printf("cluster %s is younger than %.1f hours, too young "+
+					"to be primary, keeping", cluster.Name,
+					cfg.Cluster.MinPrimaryAge)
+				primaryReasons[cluster.Name] = fmt.Sprintf("not primary, "+
+					"younger than Cluster.MinPrimaryAge=%.1f hours, keeping",
+					cfg.Cluster.MinPrimaryAge)
+				continue
+			}
+
+			// Keep clusters whose console could not be reached, they will
+			// become primary once it can be
+			if !cluster.ConsoleReachable {
+				logger.Printf("cluster %s failed console check, cannot be "+
+					"primary, keeping", cluster.Name)
+				primaryReasons[cluster.Name] = "not primary, failed console " +
+					"check, keeping"
+				continue
+			}
+
+			osInstallPlan.Delete = append(osInstallPlan.Delete, cluster)
+			primaryReasons[cluster.Name] = fmt.Sprintf("not primary, %s is "+
+				"healthier or younger, will delete", primaryCluster.Name)
+		}
+	}
+
+	// Plan to delete orphaned clusters
+	for _, cluster := range orphans {
+		if cfg.Cluster.RequireRunning && !cluster.Running {
+			logger.Printf("not deleting orphaned cluster %s, not all of its "+
+				"instances are running and Cluster.RequireRunning is true",
+				cluster.Name)
+			continue
+		}
+
+		osInstallPlan.Delete = append(osInstallPlan.Delete, cluster)
+	}
+
+	// Plan to delete clusters without instances
+	for _, cluster := range state.Instanceless {
+		osInstallPlan.Delete = append(osInstallPlan.Delete, cluster)
+	}
+
+	// Remove duplicate deletions
+	// Deleting a cluster twice would run openshift-install destroy twice
+	osInstallPlan.Delete = uniqueClusters(osInstallPlan.Delete)
+
+	// Never delete the primary cluster, even if another rule planned to
+	if primaryCluster != nil {
+		deletes := []Cluster{}
+		for _, cluster := range osInstallPlan.Delete {
+			if cluster.Name != primaryCluster.Name {
+				deletes = append(deletes, cluster)
+			}
+		}
+		osInstallPlan.Delete = deletes
+	}
+
+	// Delete oldest clusters first
+	// Deletions are planned from maps, so without sorting which clusters
+	// Cluster.MinHealthy and Cluster.MaxDeletes defer would be random
+	sort.Slice(osInstallPlan.Delete, func(i, j int) bool {
+		if osInstallPlan.Delete[i].Age != osInstallPlan.Delete[j].Age {
+			return osInstallPlan.Delete[i].Age > osInstallPlan.Delete[j].Age
+		}
+
+		return osInstallPlan.Delete[i].Name < osInstallPlan.Delete[j].Name
+	})
+
+	// Keep serving from current cluster if no cluster can be primary
+	if primaryCluster == nil {
+		logger.Printf("no cluster can be primary, keeping cluster %s which "+
+			"DNS points to", state.RecordsCluster)
+		if _, ok := primaryReasons[state.RecordsCluster]; ok {
+			primaryReasons[state.RecordsCluster] += ", but no cluster can be " +
+				"primary so kept since DNS points to it"
+		}
+
+		deletes := []Cluster{}
+		for _, cluster := range osInstallPlan.Delete {
+			if cluster.Name != state.RecordsCluster {
+				deletes = append(deletes, cluster)
+			}
+		}
+		osInstallPlan.Delete = deletes
+	}
+
+	// Keep minimum number of healthy clusters
+	if cfg.Cluster.MinHealthy > 0 {
+		// healthy returns true if a cluster passed its health probe, or if
+		// there is no health probe data, if all its instances are running
+		healthy := func(cluster Cluster) bool {
+			if cfg.Health.Probe {
+				return cluster.Healthy
+			}
+
+			return cluster.Running
+		}
+
+		// Only clusters which are managed are counted, ignored clusters and
+		// clusters left alone by Cluster.RequireRunning could be deleted at
+		// any time. Clusters too young to be primary are counted, they are
+		// available even though they are not used yet.
+		healthyCount := uint(0)
+		for _, cluster := range clusters {
+			if cluster.Ignored || (cfg.Cluster.RequireRunning && !cluster.Running) {
+				continue
+			}
+
+			if healthy(cluster) {
+				healthyCount++
+			}
+		}
+
+		// Deletions are sorted oldest first, so the youngest healthy
+		// clusters are kept
+		deletes := []Cluster{}
+		deferred := []string{}
+		for _, cluster := range osInstallPlan.Delete {
+			// Orphaned clusters and clusters without instances are not counted
+			if _, ok := clusters[cluster.Name]; !ok || !healthy(cluster) {
+				deletes = append(deletes, cluster)
+				continue
+			}
+
+			if healthyCount <= cfg.Cluster.MinHealthy {
+				deferred = append(deferred, cluster.Name)
+				continue
+			}
+
+			healthyCount--
+			deletes = append(deletes, cluster)
+		}
+		osInstallPlan.Delete = deletes
+
+		if len(deferred) > 0 {
+			logger.Printf("deferring deletion of healthy clusters, deleting "+
+				"would leave fewer than Cluster.MinHealthy=%d healthy clusters: "+
+				"%s", cfg.Cluster.MinHealthy, strings.Join(deferred, ", "))
+		}
+	}
+
+	// Limit number of deletions
+	// The youngest clusters are deferred
+	if uint(len(osInstallPlan.Delete)) > cfg.Cluster.MaxDeletes {
+		deferred := []string{}
+		for _, cluster := range osInstallPlan.Delete[cfg.Cluster.MaxDeletes:] {
+			deferred = append(deferred, cluster.Name)
+		}
+
+		logger.Printf("WARNING: planned to delete %d clusters which is more "+
+			"than Cluster.MaxDeletes=%d, deferring deletion of: %s",
+			len(osInstallPlan.Delete), cfg.Cluster.MaxDeletes,
+			strings.Join(deferred, ", "))
+
+		osInstallPlan.Delete = osInstallPlan.Delete[:cfg.Cluster.MaxDeletes]
+	}
+
+	return osInstallPlan, primaryCluster, primaryReasons, nil
+}
+
 // CFDNSPlan is a plan of actions for Cloudflare DNS
 type CFDNSPlan struct {
 	// Set DNS records. The CFDNSRecord.Record.Content and
@@ -185,6 +1618,111 @@ func (p CFDNSPlan) String() string {
 	return fmt.Sprintf("Set=[%s]", strings.Join(setStrs, ", "))
 }
 
+// MarshalYAML returns a YAML representation of CFDNSPlan
+func (p CFDNSPlan) MarshalYAML() (interface{}, error) {
+	set := []yaml.MapSlice{}
+	for _, record := range p.Set {
+		set = append(set, yaml.MapSlice{
+			{Key: "name", Value: record.Record.Name},
+			{Key: "content", Value: record.Record.Content},
+		})
+	}
+
+	return yaml.MapSlice{
+		{Key: "set", Value: set},
+	}, nil
+}
+
+// ActionOutcome is the outcome of a planned action
+type ActionOutcome struct {
+	// Action is the type of action, ex., "create"
+	Action string
+
+	// Target is the name of the cluster or DNS record the action concerns
+	Target string
+
+	// Outcome is "completed", "failed", or "skipped"
+	Outcome string
+}
+
+// ExecutionResult records the outcomes of the actions in a plan
+type ExecutionResult struct {
+	// Outcomes of actions in the order they were planned
+	Outcomes []ActionOutcome
+}
+
+// Planned records that an action is planned, its outcome is "skipped" until
+// recorded otherwise
+func (r *ExecutionResult) Planned(action, target string) {
+	r.Outcomes = append(r.Outcomes, ActionOutcome{
+		Action:  action,
+		Target:  target,
+		Outcome: "skipped",
+	})
+}
+
+// Record the outcome of a planned action
+func (r *ExecutionResult) Record(action, target, outcome string) {
+	for i, o := range r.Outcomes {
+		if o.Action == action && o.Target == target {
+			r.Outcomes[i].Outcome = outcome
+			return
+		}
+	}
+}
+
+// Counts returns the number of actions of each type, keys are actions. If outcome
+// is not empty only actions with that outcome are counted.
+func (r ExecutionResult) Counts(outcome string) map[string]int {
+	counts := map[string]int{}
+	for _, o := range r.Outcomes {
+		if len(outcome) == 0 || o.Outcome == outcome {
+			counts[o.Action]++
+		}
+	}
+
+	return counts
+}
+
+// Diverged returns true if any planned action was not completed
+func (r ExecutionResult) Diverged() bool {
+	for _, o := range r.Outcomes {
+		if o.Outcome != "completed" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String summarizes the planned and completed actions
+func (r ExecutionResult) String() string {
+	planned := r.Counts("")
+	completed := r.Counts("completed")
+
+	actions := []string{}
+	for action := range planned {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	if len(actions) == 0 {
+		return "planned nothing"
+	}
+
+	plannedStrs := []string{}
+	completedStrs := []string{}
+	for _, action := range actions {
+		plannedStrs = append(plannedStrs, fmt.Sprintf("%d %s", planned[action],
+			action))
+		completedStrs = append(completedStrs, fmt.Sprintf("%d %s",
+			completed[action], action))
+	}
+
+	return fmt.Sprintf("planned %s; completed %s", strings.Join(plannedStrs, ", "),
+		strings.Join(completedStrs, ", "))
+}
+
 // HelmInstallPlan is a plan to install a Helm chart on a Kubernetes cluster
 type HelmInstallPlan struct {
 	// ChartGitURI is the location of a Git repo holding the Helm chart to install
@@ -203,84 +1741,2666 @@ func (p HelmInstallPlan) String() string {
 		p.Namespace)
 }
 
-// runCmd runs a command as a subprocess, handles printing out stdout and stderr
-func runCmd(stdoutLogger, stderrLogger *log.Logger, cmd *exec.Cmd) error {
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe: %s", err.Error())
+// MarshalYAML returns a YAML representation of HelmInstallPlan
+func (p HelmInstallPlan) MarshalYAML() (interface{}, error) {
+	return yaml.MapSlice{
+		{Key: "chart", Value: p.ChartGitURI},
+		{Key: "cluster", Value: p.Cluster.Name},
+		{Key: "namespace", Value: p.Namespace},
+	}, nil
+}
+
+// yamlAPIVersion is the apiVersion of YAML documents output by the program
+const yamlAPIVersion = "auto-cluster.kscout.io/v1alpha1"
+
+// YAMLDocument is a Kubernetes style YAML document
+type YAMLDocument struct {
+	// APIVersion is always yamlAPIVersion
+	APIVersion string `yaml:"apiVersion"`
+
+	// Kind of document
+	Kind string `yaml:"kind"`
+
+	// Metadata about document
+	Metadata YAMLMetadata `yaml:"metadata"`
+
+	// Spec is the desired state
+	Spec interface{} `yaml:"spec,omitempty"`
+
+	// Status is the current state
+	Status interface{} `yaml:"status,omitempty"`
+}
+
+// YAMLMetadata is metadata about a YAMLDocument
+type YAMLMetadata struct {
+	// Name of document
+	Name string `yaml:"name"`
+}
+
+// writeYAMLDocuments writes a stream of YAML documents
+func writeYAMLDocuments(w io.Writer, docs []YAMLDocument) error {
+	for _, doc := range docs {
+		doc.APIVersion = yamlAPIVersion
+
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s %s as YAML: %s", doc.Kind,
+				doc.Metadata.Name, err.Error())
+		}
+
+		if _, err := fmt.Fprintf(w, "---\n%s", out); err != nil {
+			return fmt.Errorf("failed to write YAML: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Metrics holds values exposed in the Prometheus text exposition format.
+// It is safe for concurrent use.
+type Metrics struct {
+	// mutex guards all other fields
+	mutex sync.Mutex
+
+	// help text of metrics, keys are metric names
+	help map[string]string
+
+	// types of metrics, either "gauge", "counter", or "histogram", keys are
+	// metric names
+	types map[string]string
+
+	// values of metric series, keys are metric names, inner keys are label
+	// pairs in the format: name="value",... Histograms are stored as their
+	// _bucket, _sum, and _count series.
+	values map[string]map[string]float64
+}
+
+// NewMetrics creates a Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		help:   map[string]string{},
+		types:  map[string]string{},
+		values: map[string]map[string]float64{},
+	}
+}
+
+// Describe sets the type and help text of a metric
+func (m *Metrics) Describe(name, typ, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.types[name] = typ
+	m.help[name] = help
+}
+
+// Set the value of a metric series
+func (m *Metrics) Set(name, labels string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.values[name]; !ok {
+		m.values[name] = map[string]float64{}
+	}
+
+	m.values[name][labels] = value
+}
+
+// Add to the value of a metric series
+func (m *Metrics) Add(name, labels string, delta float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.values[name]; !ok {
+		m.values[name] = map[string]float64{}
+	}
+
+	m.values[name][labels] += delta
+}
+
+// Observe records a value in a histogram series with buckets, which are upper
+// bounds in ascending order
+func (m *Metrics) Observe(name, labels string, buckets []float64, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if _, ok := m.values[name+suffix]; !ok {
+			m.values[name+suffix] = map[string]float64{}
+		}
+	}
+
+	labelsPrefix := ""
+	if len(labels) > 0 {
+		labelsPrefix = labels + ","
+	}
+
+	for _, bucket := range buckets {
+		le := fmt.Sprintf("%sle=\"%s\"", labelsPrefix,
+			strconv.FormatFloat(bucket, 'f', -1, 64))
+		m.values[name+"_bucket"][le] += 0
+		if value <= bucket {
+			m.values[name+"_bucket"][le]++
+		}
+	}
+	m.values[name+"_bucket"][labelsPrefix+"le=\"+Inf\""]++
+
+	m.values[name+"_sum"][labels] += value
+	m.values[name+"_count"][labels]++
+}
+
+// family returns the name of the metric a series belongs to, which is different
+// from the series name for histograms
+func (m *Metrics) family(name string) string {
+	if _, ok := m.types[name]; ok {
+		return name
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base != name && m.types[base] == "histogram" {
+			return base
+		}
+	}
+
+	return name
+}
+
+// Reset removes all series of a metric
+func (m *Metrics) Reset(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.values, name)
+}
+
+// WriteTo writes metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	return m.write(w, false)
+}
+
+// WriteOpenMetricsTo writes metrics in the OpenMetrics text format
+func (m *Metrics) WriteOpenMetricsTo(w io.Writer) (int64, error) {
+	return m.write(w, true)
+}
+
+// write metrics in the Prometheus text exposition format, or if openMetrics is
+// true the OpenMetrics text format. The formats differ in that OpenMetrics
+// counter families are named without the _total suffix and output ends with
+// an EOF line.
+func (m *Metrics) write(w io.Writer, openMetrics bool) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := []string{}
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer([]byte{})
+
+	// lastFamily is the metric whose HELP and TYPE lines were last written, so
+	// they are written once for the series of a histogram
+	lastFamily := ""
+
+	for _, name := range names {
+		if family := m.family(name); family != lastFamily {
+			familyName := family
+			if openMetrics && m.types[family] == "counter" {
+				familyName = strings.TrimSuffix(family, "_total")
+			}
+
+			if help, ok := m.help[family]; ok {
+				fmt.Fprintf(buf, "# HELP %s %s\n", familyName, help)
+			}
+
+			if typ, ok := m.types[family]; ok {
+				fmt.Fprintf(buf, "# TYPE %s %s\n", familyName, typ)
+			}
+
+			lastFamily = family
+		}
+
+		labelSets := []string{}
+		for labels := range m.values[name] {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+
+		for _, labels := range labelSets {
+			series := name
+			if len(labels) > 0 {
+				series = fmt.Sprintf("%s{%s}", name, labels)
+			}
+
+			fmt.Fprintf(buf, "%s %s\n", series,
+				strconv.FormatFloat(m.values[name][labels], 'f', -1, 64))
+		}
+	}
+
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+
+	return buf.WriteTo(w)
+}
+
+// createDurationBuckets are the buckets of the auto_cluster_create_duration_seconds
+// histogram, openshift-install usually takes 30 to 45 minutes
+var createDurationBuckets = []float64{1200, 1800, 2400, 2700, 3000, 3600, 5400,
+	7200}
+
+// LoopStatus records when control loop executions succeed. It is safe for
+// concurrent use.
+type LoopStatus struct {
+	// mutex guards all other fields
+	mutex sync.Mutex
+
+	// startedOn is when the process started
+	startedOn time.Time
+
+	// lastSuccess is when the last successful control loop execution finished,
+	// zero if there has not been one
+	lastSuccess time.Time
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewLoopStatus creates a LoopStatus
+func NewLoopStatus() *LoopStatus {
+	return &LoopStatus{
+		startedOn: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Succeeded records that a control loop execution just succeeded
+func (s *LoopStatus) Succeeded() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSuccess = s.now()
+}
+
+// LastSuccess returns when the last successful control loop execution finished,
+// zero if there has not been one
+func (s *LoopStatus) LastSuccess() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastSuccess
+}
+
+// Stale returns true if no control loop execution has succeeded within maxAge.
+// Before the first success the time the process started is used.
+func (s *LoopStatus) Stale(maxAge time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	since := s.startedOn
+	if !s.lastSuccess.IsZero() {
+		since = s.lastSuccess
+	}
+
+	return s.now().Sub(since) > maxAge
+}
+
+// readyzHandler responds to /readyz requests with 503 if no control loop execution
+// has succeeded within staleAge
+func readyzHandler(status *LoopStatus, breaker *CreateBreaker,
+	staleAge time.Duration) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		lastSuccess := "never"
+		if t := status.LastSuccess(); !t.IsZero() {
+			lastSuccess = t.Format(time.RFC3339)
+		}
+
+		if status.Stale(staleAge) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready, last successful control loop execution: %s",
+				lastSuccess)
+			return
+		}
+
+		fmt.Fprintf(w, "ready, last successful control loop execution: %s",
+			lastSuccess)
+
+		if breaker.Open() {
+			fmt.Fprintf(w, ", cluster creation paused after %d failures in a row",
+				breaker.Failures())
+		}
+	}
+}
+
+// CreateBreaker is a circuit breaker which pauses cluster creation after creating a
+// cluster fails too many times in a row. It is safe for concurrent use.
+type CreateBreaker struct {
+	// mutex guards all other fields
+	mutex sync.Mutex
+
+	// failures is the number of times in a row creating a cluster failed
+	failures uint
+
+	// openedOn is when the breaker last opened, zero if it has not
+	openedOn time.Time
+
+	// cooldown is how long the breaker stays open, see Open
+	cooldown time.Duration
+}
+
+// SetCooldown sets how long the breaker stays open after it opens. Kept with the
+// breaker so readers in other goroutines do not need the configuration.
+func (b *CreateBreaker) SetCooldown(cooldown time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.cooldown = cooldown
+}
+
+// Failed records that creating a cluster failed. Returns true if the breaker
+// opened because there have been limit failures in a row.
+func (b *CreateBreaker) Failed(limit uint) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+
+	if b.failures >= limit {
+		b.openedOn = time.Now()
+		return true
+	}
+
+	return false
+}
+
+// Trip opens the breaker regardless of the number of failures, for failures which
+// will not be fixed by retrying
+func (b *CreateBreaker) Trip() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.openedOn = time.Now()
+}
+
+// Succeeded records that creating a cluster succeeded, which closes the breaker
+func (b *CreateBreaker) Succeeded() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.openedOn = time.Time{}
+}
+
+// Open returns true if cluster creation is paused, which is the case for the
+// cooldown after the breaker opened. After the cooldown one attempt is allowed, if
+// it fails the breaker opens again.
+func (b *CreateBreaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.openedOn.IsZero() && time.Since(b.openedOn) < b.cooldown
+}
+
+// Failures returns the number of times in a row creating a cluster failed
+func (b *CreateBreaker) Failures() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.failures
+}
+
+// quotaExceededExp matches openshift-install output which indicates an AWS quota
+// was exceeded
+var quotaExceededExp = regexp.MustCompile(
+	"(?i)(LimitExceeded|QuotaExceeded|exceeded .*quota|quota .*exceeded)")
+
+// nameCollisionExp matches openshift-install output which indicates AWS resources
+// with the cluster's name already exist, ex., left over from a cluster which was
+// not completely destroyed
+var nameCollisionExp = regexp.MustCompile(
+	"(?i)(AlreadyExists|already exists)")
+
+// MatchWriter is an io.Writer which records the first write which matches a
+// regular expression. It is safe for concurrent use.
+type MatchWriter struct {
+	// exp to match
+	exp *regexp.Regexp
+
+	// mutex guards matched
+	mutex sync.Mutex
+
+	// matched is the first write which matched, empty if none have
+	matched string
+}
+
+// NewMatchWriter creates a MatchWriter
+func NewMatchWriter(exp *regexp.Regexp) *MatchWriter {
+	return &MatchWriter{
+		exp: exp,
+	}
+}
+
+// Write records p if it matches and nothing has matched yet
+func (w *MatchWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.matched) == 0 && w.exp.Match(p) {
+		w.matched = strings.TrimSpace(string(p))
+	}
+
+	return len(p), nil
+}
+
+// Matched returns the first write which matched, empty if none have
+func (w *MatchWriter) Matched() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.matched
+}
+
+// postSlack posts a message to a Slack incoming webhook
+func postSlack(webhook, text string) error {
+	buf := bytes.NewBuffer([]byte{})
+	if err := json.NewEncoder(buf).Encode(map[string]string{"text": text}); err != nil {
+		return fmt.Errorf("failed to encode Slack message as JSON: %s", err.Error())
+	}
+
+	resp, err := http.Post(webhook, "application/json", buf)
+	if err != nil {
+		return fmt.Errorf("failed to post Slack message: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// retryBackoff calls fn until it succeeds or it has been called attempts times.
+// After the first failure backoff is waited, the wait doubles after each failure.
+// Returns the last error returned by fn.
+func retryBackoff(logger *log.Logger, desc string, attempts uint, backoff time.Duration,
+	fn func() error) error {
+
+	var err error = nil
+
+	for attempt := uint(1); attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if attempt < attempts {
+			logger.Printf("failed to %s, attempt %d/%d, retrying in %s: %s",
+				desc, attempt, attempts, backoff.String(), err.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return err
+}
+
+// maxAWSThrottleBackoff is the longest time retryAWSThrottle will wait between retries
+const maxAWSThrottleBackoff = time.Second * 30
+
+// isAWSThrottleErr returns true if err is an AWS API throttling error
+func isAWSThrottleErr(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case "RequestLimitExceeded", "Throttling":
+		return true
+	default:
+		return false
+	}
+}
+
+// clockSkew returns how far the local clock is ahead of a server's clock, given
+// the Date header of a response from the server received at received. The header
+// only has second precision.
+func clockSkew(dateHeader string, received time.Time) (time.Duration, error) {
+	serverTime, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse Date header \"%s\": %s", dateHeader,
+			err.Error())
+	}
+
+	return received.Sub(serverTime), nil
+}
+
+// isAWSCredentialsErr returns true if err is caused by missing, invalid, expired,
+// or unauthorized AWS credentials, which retrying will not fix
+func isAWSCredentialsErr(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case "NoCredentialProviders", "InvalidClientTokenId", "InvalidAccessKeyId",
+		"SignatureDoesNotMatch", "ExpiredToken", "ExpiredTokenException",
+		"UnrecognizedClientException", "MissingAuthenticationToken",
+		"AccessDenied", "AuthFailure":
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAWSThrottle calls fn until it returns an error which is not an AWS API
+// throttling error, or until maxWait has elapsed. Retries are delayed using
+// exponential backoff with full jitter. Returns the number of throttling errors
+// encountered and the last error returned by fn.
+func retryAWSThrottle(logger *log.Logger, maxWait time.Duration, fn func() error) (uint, error) {
+	start := time.Now()
+	throttles := uint(0)
+	backoff := time.Second
+
+	for {
+		err := fn()
+		if err == nil || !isAWSThrottleErr(err) {
+			return throttles, err
+		}
+
+		throttles++
+
+		if time.Since(start) >= maxWait {
+			return throttles, fmt.Errorf("throttled for longer than %s: %s",
+				maxWait.String(), err.Error())
+		}
+
+		wait := time.Duration(rand.Int63n(int64(backoff)))
+		logger.Printf("AWS API throttled request, retrying in %s: %s",
+			wait.String(), err.Error())
+		time.Sleep(wait)
+
+		backoff *= 2
+		if backoff > maxAWSThrottleBackoff {
+			backoff = maxAWSThrottleBackoff
+		}
+	}
+}
+
+// bytesPerGB is the number of bytes in a gigabyte
+const bytesPerGB = 1024 * 1024 * 1024
+
+// freeSpace returns the number of bytes free for unprivileged users on the file
+// system which holds path
+func freeSpace(path string) (uint64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat file system: %s", err.Error())
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// checkFreeSpace returns the free space of Config.OpenShiftInstall.StateStorePath,
+// and WorkDir if set, keyed by path. An error is returned if any has less than
+// Config.OpenShiftInstall.MinFreeSpace.
+func checkFreeSpace(cfg Config) (map[string]uint64, error) {
+	paths := []string{cfg.OpenShiftInstall.StateStorePath}
+	if len(cfg.OpenShiftInstall.WorkDir) > 0 {
+		paths = append(paths, cfg.OpenShiftInstall.WorkDir)
+	}
+
+	free := map[string]uint64{}
+	for _, path := range paths {
+		pathFree, err := freeSpace(path)
+		if err != nil {
+			return free, fmt.Errorf("failed to get free space of %s: %s", path,
+				err.Error())
+		}
+		free[path] = pathFree
+	}
+
+	minFree := uint64(cfg.OpenShiftInstall.MinFreeSpace * bytesPerGB)
+	for _, path := range paths {
+		if free[path] < minFree {
+			return free, fmt.Errorf("%s has %.1f GB of free disk space, less than "+
+				"OpenShiftInstall.MinFreeSpace of %.1f GB", path,
+				float64(free[path])/bytesPerGB, cfg.OpenShiftInstall.MinFreeSpace)
+		}
+	}
+
+	return free, nil
+}
+
+// prepareStateStore creates an openshift-install state store or work directory if
+// it does not exist and ensures it is writable
+func prepareStateStore(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %s", err.Error())
+	}
+
+	f, err := ioutil.TempFile(path, ".write-test")
+	if err != nil {
+		return fmt.Errorf("directory is not writable: %s", err.Error())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close write test file: %s", err.Error())
+	}
+
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("failed to remove write test file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// checkTrustBundle returns an error if the file at path does not contain only PEM
+// encoded certificates
+func checkTrustBundle(path string) error {
+	rest, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	numCerts := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("failed to parse certificate %d: %s", numCerts+1,
+				err.Error())
+		}
+
+		numCerts++
+	}
+
+	if numCerts == 0 {
+		return fmt.Errorf("no PEM encoded certificates found")
+	}
+
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("found data which is not a PEM encoded certificate after "+
+			"certificate %d", numCerts)
+	}
+
+	return nil
+}
+
+// pullSecretPath returns the path of the pull secret file used to create clusters
+func pullSecretPath(cfg Config) string {
+	if len(cfg.OpenShiftInstall.PullSecretPath) > 0 {
+		return cfg.OpenShiftInstall.PullSecretPath
+	}
+
+	return filepath.Join(cfg.OpenShiftInstall.StateStorePath, "pull-secret")
+}
+
+// checkPullSecret returns an error if the pull secret file at path is not a regular
+// file which can be read. The file's contents are never read.
+func checkPullSecret(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("file does not exist")
+	} else if os.IsPermission(err) {
+		return fmt.Errorf("permission denied while accessing file")
+	} else if err != nil {
+		return fmt.Errorf("failed to stat file: %s", err.Error())
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("is a directory, not a file")
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("is not a regular file, mode: %s", info.Mode().String())
+	}
+
+	if info.Size() == 0 {
+		return fmt.Errorf("file is empty")
+	}
+
+	f, err := os.Open(path)
+	if os.IsPermission(err) {
+		return fmt.Errorf("file is not readable, permission denied")
+	} else if err != nil {
+		return fmt.Errorf("failed to open file: %s", err.Error())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// stateInfraID returns the infrastructure ID of a cluster from the metadata file
+// openshift-install stores in its state directory, or its backup from a failed
+// delete. Empty if neither can be read.
+func stateInfraID(cfg Config, clusterName string) string {
+	dir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, clusterName)
+	metadataBytes, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		metadataBytes, err = ioutil.ReadFile(filepath.Join(dir, metadataBackupFile))
+	}
+	if err != nil {
+		return ""
+	}
+
+	var metadata struct {
+		InfraID string `json:"infraID"`
+	}
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return ""
+	}
+
+	return metadata.InfraID
+}
+
+// ClusterCredentials are used to access a cluster, from the files openshift-install
+// stores in its state directory
+type ClusterCredentials struct {
+	// ConsoleURL is the URL of the cluster's web console. Empty if unknown.
+	ConsoleURL string
+
+	// KubeadminPassword is the web console password of the kubeadmin user. Must
+	// never be logged.
+	KubeadminPassword string
+}
+
+// consoleURLExp matches the openshift-install log line with a cluster's web console
+// URL. The first group is the URL.
+var consoleURLExp = regexp.MustCompile(`web-console here: (https://[^"\\\s]+)`)
+
+// installPasswordExp matches the kubeadmin password in openshift-install output.
+// The first group is the text before the password.
+var installPasswordExp = regexp.MustCompile(`(password: \\?")[^"\\]+`)
+
+// redactInstallPassword replaces the kubeadmin password in a line of
+// openshift-install output
+func redactInstallPassword(line string) string {
+	return installPasswordExp.ReplaceAllString(line, "${1}REDACTED")
+}
+
+// readClusterCredentials reads a cluster's credentials from its state directory.
+// The console URL is read from openshift-install's log, it is empty if not found.
+func readClusterCredentials(cfg Config, clusterName string) (ClusterCredentials,
+	error) {
+
+	creds := ClusterCredentials{}
+	dir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, clusterName)
+
+	pw, err := ioutil.ReadFile(filepath.Join(dir, "auth", "kubeadmin-password"))
+	if err != nil {
+		return creds, fmt.Errorf("failed to read kubeadmin password: %s", err.Error())
+	}
+	creds.KubeadminPassword = strings.TrimSpace(string(pw))
+
+	installLog, err := ioutil.ReadFile(filepath.Join(dir, ".openshift_install.log"))
+	if err != nil && !os.IsNotExist(err) {
+		return creds, fmt.Errorf("failed to read openshift-install log: %s",
+			err.Error())
+	}
+
+	// Use the last URL in case the log has output from multiple runs
+	for _, match := range consoleURLExp.FindAllSubmatch(installLog, -1) {
+		creds.ConsoleURL = string(match[1])
+	}
+
+	return creds, nil
+}
+
+// annotationsFile is the name of the file in a cluster's state directory which
+// holds operator notes about the cluster, see readAnnotations
+const annotationsFile = "annotations.json"
+
+// annotationsDir returns the state directory of a cluster for readAnnotations and
+// writeAnnotations. Returns an error if clusterName is not a valid cluster name or
+// the directory is not inside Config.OpenShiftInstall.StateStorePath.
+func annotationsDir(cfg Config, clusterName string) (string, error) {
+	if err := validClusterName(clusterName); err != nil {
+		return "", fmt.Errorf("invalid cluster name \"%s\": %s", clusterName,
+			err.Error())
+	}
+
+	storePath, err := filepath.Abs(cfg.OpenShiftInstall.StateStorePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve state store path: %s", err.Error())
+	}
+
+	dir := filepath.Join(storePath, clusterName)
+	if rel, err := filepath.Rel(storePath, dir); err != nil || rel != clusterName {
+		return "", fmt.Errorf("state directory %s is not in state store %s", dir,
+			storePath)
+	}
+
+	return dir, nil
+}
+
+// readAnnotations reads the annotations of a cluster from its state directory.
+// Annotations are free form notes which are only shown to operators, they do not
+// change how the cluster is managed. Returns an empty map if the cluster has no
+// annotations.
+func readAnnotations(cfg Config, clusterName string) (map[string]string, error) {
+	annotations := map[string]string{}
+
+	dir, err := annotationsDir(cfg, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	annotationsBytes, err := ioutil.ReadFile(filepath.Join(dir, annotationsFile))
+	if os.IsNotExist(err) {
+		return annotations, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", annotationsFile, err.Error())
+	}
+
+	if err := json.Unmarshal(annotationsBytes, &annotations); err != nil {
+		return nil, fmt.Errorf("failed to parse %s as JSON: %s", annotationsFile,
+			err.Error())
+	}
+
+	return annotations, nil
+}
+
+// writeAnnotations writes the annotations of a cluster to its state directory,
+// which must exist. The annotations file is removed if annotations is empty.
+func writeAnnotations(cfg Config, clusterName string, annotations map[string]string) error {
+	dir, err := annotationsDir(cfg, clusterName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to stat state directory %s: %s", dir, err.Error())
+	}
+
+	path := filepath.Join(dir, annotationsFile)
+
+	if len(annotations) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %s", annotationsFile, err.Error())
+		}
+		return nil
+	}
+
+	annotationsBytes, err := json.MarshalIndent(annotations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal as JSON: %s", err.Error())
+	}
+
+	if err := ioutil.WriteFile(path, append(annotationsBytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", annotationsFile, err.Error())
+	}
+
+	return nil
+}
+
+// checkImportDir checks an openshift-install state directory holds a cluster which
+// can be managed: its name matches Config.Cluster.NamePrefix followed by a number,
+// its metadata is consistent, it has credentials, and no cluster with the same
+// name is in Config.OpenShiftInstall.StateStorePath. Returns the cluster's name and
+// infrastructure ID.
+func checkImportDir(cfg Config, dir string) (string, string, error) {
+	name := filepath.Base(filepath.Clean(dir))
+
+	if err := validClusterName(name); err != nil {
+		return "", "", fmt.Errorf("directory name \"%s\" is not a valid cluster "+
+			"name: %s", name, err.Error())
+	}
+
+	num := strings.TrimPrefix(name, cfg.Cluster.NamePrefix)
+	if _, err := strconv.ParseInt(num, 10, 64); err != nil || num == name {
+		return "", "", fmt.Errorf("directory name \"%s\" must be "+
+			"Cluster.NamePrefix \"%s\" followed by a number", name,
+			cfg.Cluster.NamePrefix)
+	}
+
+	metadataBytes, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read metadata.json: %s", err.Error())
+	}
+
+	var metadata struct {
+		ClusterName string `json:"clusterName"`
+		InfraID     string `json:"infraID"`
+		AWS         *struct {
+			Region string `json:"region"`
+		} `json:"aws"`
+	}
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return "", "", fmt.Errorf("failed to parse metadata.json: %s", err.Error())
+	}
+
+	if metadata.ClusterName != name {
+		return "", "", fmt.Errorf("metadata.json clusterName \"%s\" does not match "+
+			"directory name \"%s\"", metadata.ClusterName, name)
+	}
+
+	if !strings.HasPrefix(metadata.InfraID, name+"-") {
+		return "", "", fmt.Errorf("metadata.json infraID \"%s\" is not the "+
+			"cluster name followed by a suffix", metadata.InfraID)
+	}
+
+	if metadata.AWS == nil || metadata.AWS.Region != awsRegion {
+		return "", "", fmt.Errorf("metadata.json must be for an AWS cluster in the "+
+			"%s region", awsRegion)
+	}
+
+	for _, file := range []string{"kubeconfig", "kubeadmin-password"} {
+		if _, err := os.Stat(filepath.Join(dir, "auth", file)); err != nil {
+			return "", "", fmt.Errorf("cluster has no credentials: %s", err.Error())
+		}
+	}
+
+	dest := filepath.Join(cfg.OpenShiftInstall.StateStorePath, name)
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("%s already exists, a cluster with the same "+
+			"name is managed", dest)
+	}
+
+	return name, metadata.InfraID, nil
+}
+
+// copyDir recursively copies the directory src to dst, which must not exist.
+// File modes are preserved.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.Mkdir(target, info.Mode().Perm())
+		}
+
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file or directory", path)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+			info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+
+		return out.Close()
+	})
+}
+
+// nextClusterName returns the name of the next cluster to create. It is
+// Config.Cluster.NamePrefix followed by 1 more than the highest number of any
+// state directory with the prefix.
+func nextClusterName(cfg Config) (string, error) {
+	maxClusterNum := int64(0)
+
+	// Find highest numeric value in openshift install data store path
+	dirs, err := ioutil.ReadDir(cfg.OpenShiftInstall.StateStorePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read existing cluster credentials "+
+			"directory: %s", err.Error())
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		if !strings.HasPrefix(dir.Name(), cfg.Cluster.NamePrefix) {
+			continue
+		}
+
+		numStr := strings.ReplaceAll(dir.Name(), cfg.Cluster.NamePrefix, "")
+		num, err := strconv.ParseInt(numStr, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse cluster number for previous "+
+				"cluster credentials directory %s: %s", dir.Name(), err.Error())
+		}
+
+		if num > maxClusterNum {
+			maxClusterNum = num
+		}
+	}
+
+	// Add 1 to highest found numeric prefix
+	nextClusterNum := maxClusterNum + 1
+	nextClusterNumStr := fmt.Sprintf("%d", nextClusterNum)
+	if nextClusterNum < 10 {
+		nextClusterNumStr = fmt.Sprintf("0%s", nextClusterNumStr)
+	}
+
+	name := fmt.Sprintf("%s%s", cfg.Cluster.NamePrefix, nextClusterNumStr)
+	if err := validClusterName(name); err != nil {
+		return "", fmt.Errorf("generated name \"%s\" is invalid: %s", name,
+			err.Error())
+	}
+
+	return name, nil
+}
+
+// infraIDFromName returns the infrastructure ID from the name of a cluster's
+// instance, which openshift-install names <infrastructure ID>-<role>-<suffix>. The
+// infrastructure ID is the cluster name followed by 5 random characters. Empty if
+// the name does not have this format.
+func infraIDFromName(instanceName, clusterName string) string {
+	if !strings.HasPrefix(instanceName, clusterName+"-") {
+		return ""
+	}
+
+	random := strings.SplitN(strings.TrimPrefix(instanceName, clusterName+"-"), "-",
+		2)[0]
+	if len(random) != 5 {
+		return ""
+	}
+
+	return clusterName + "-" + random
+}
+
+// findInstancelessClusters finds clusters with a state directory which
+// openshift-install has not destroyed but which are not in clusters or orphans,
+// and have no instances. Clusters are only in clusters or orphans if they passed
+// discovery's filters, so instanceStates is used to check for instances which
+// were left out. It returns the states of the instances, which are not
+// terminated, with the cluster owned tag of an infrastructure ID. Clusters with
+// instances, ex., stopped or not managed, are kept. Keys of the result are
+// cluster names. Ages are from when the cluster's metadata was written, relative
+// to now.
+func findInstancelessClusters(logger *log.Logger, cfg Config, clusters,
+	orphans map[string]Cluster, now time.Time,
+	instanceStates func(infraID string) ([]string, error)) (map[string]Cluster, error) {
+
+	instanceless := map[string]Cluster{}
+
+	stateDirs, err := ioutil.ReadDir(cfg.OpenShiftInstall.StateStorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state store directory: %s",
+			err.Error())
+	}
+
+	for _, dir := range stateDirs {
+		if !dir.IsDir() || !strings.HasPrefix(dir.Name(), cfg.Cluster.NamePrefix) ||
+			validClusterName(dir.Name()) != nil {
+			continue
+		}
+
+		if _, ok := clusters[dir.Name()]; ok {
+			continue
+		}
+		if _, ok := orphans[dir.Name()]; ok {
+			continue
+		}
+
+		// openshift-install removes metadata.json once it destroys a cluster,
+		// without it, or its backup from a failed delete, there is nothing
+		// to destroy
+		dirPath := filepath.Join(cfg.OpenShiftInstall.StateStorePath, dir.Name())
+		metadataInfo, err := os.Stat(filepath.Join(dirPath, "metadata.json"))
+		if err != nil {
+			metadataInfo, err = os.Stat(filepath.Join(dirPath,
+				metadataBackupFile))
+		}
+		if err != nil {
+			continue
+		}
+
+		// Instances not discovered because they are stopped, have the
+		// IgnoreTagKey tag, or do not have the ManagedTagKey or
+		// Config.Cluster.EnvironmentTag tags, are found by infrastructure ID
+		infraID := stateInfraID(cfg, dir.Name())
+		if len(infraID) == 0 {
+			logger.Printf("WARNING: not deleting cluster %s which has no "+
+				"discovered instances, its infrastructure ID is unknown so it "+
+				"cannot be checked for other instances", dir.Name())
+			continue
+		}
+
+		states, err := instanceStates(infraID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances of cluster %s: %s",
+				dir.Name(), err.Error())
+		}
+
+		if len(states) > 0 {
+			stopped := true
+			for _, state := range states {
+				if state != "stopping" && state != "stopped" {
+					stopped = false
+				}
+			}
+
+			if stopped {
+				logger.Printf("cluster %s has no running instances, its instances "+
+					"were stopped, keeping since it can be restarted", dir.Name())
+			} else {
+				logger.Printf("cluster %s has instances which are not managed, "+
+					"they have the %s=true tag, or do not have the %s=true or "+
+					"Cluster.EnvironmentTag tags, keeping", dir.Name(),
+					IgnoreTagKey, ManagedTagKey)
+			}
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(dirPath, "auth",
+			"kubeadmin-password")); err == nil {
+			logger.Printf("cluster %s has no instances, its instances were "+
+				"terminated, will delete", dir.Name())
+		} else {
+			logger.Printf("cluster %s has no instances, it never finished being "+
+				"created, will delete", dir.Name())
+		}
+
+		instanceless[dir.Name()] = Cluster{
+			Name:    dir.Name(),
+			Age:     now.Sub(metadataInfo.ModTime()),
+			InfraID: infraID,
+		}
+	}
+
+	return instanceless, nil
+}
+
+// clusterNameExp matches cluster names which are DNS labels
+var clusterNameExp = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+
+// validClusterName returns an error if name is not a DNS label. Cluster names are
+// used as state store directory names, so this prevents paths outside the state
+// store.
+func validClusterName(name string) error {
+	if len(name) > 63 {
+		return fmt.Errorf("longer than 63 characters")
+	}
+
+	if !clusterNameExp.MatchString(name) {
+		return fmt.Errorf("must only contain lowercase alphanumeric characters " +
+			"and dashes, and must start and end with an alphanumeric character")
+	}
+
+	return nil
+}
+
+// normalizeConfig changes configuration values which have a single valid form.
+// Returns a message for each value which was changed.
+func normalizeConfig(cfg *Config) []string {
+	changes := []string{}
+
+	if prefix := strings.ToLower(cfg.Cluster.NamePrefix); prefix != cfg.Cluster.NamePrefix {
+		changes = append(changes, fmt.Sprintf("lowercased Cluster.NamePrefix from "+
+			"\"%s\" to \"%s\", since cluster names must be lowercase",
+			cfg.Cluster.NamePrefix, prefix))
+		cfg.Cluster.NamePrefix = prefix
+	}
+
+	return changes
+}
+
+// restartChanges returns the names of fields tagged restart:"true" whose values
+// differ between current and reloaded
+func restartChanges(current, reloaded Config) []string {
+	changes := []string{}
+	currentValue := reflect.ValueOf(current)
+	reloadedValue := reflect.ValueOf(reloaded)
+	cfgType := currentValue.Type()
+
+	for i := 0; i < cfgType.NumField(); i++ {
+		section := cfgType.Field(i)
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			if field.Tag.Get("restart") != "true" {
+				continue
+			}
+
+			if !reflect.DeepEqual(currentValue.Field(i).Field(j).Interface(),
+				reloadedValue.Field(i).Field(j).Interface()) {
+
+				changes = append(changes, section.Name+"."+field.Name)
+			}
+		}
+	}
+
+	return changes
+}
+
+// missingPrograms returns the programs needed by the scripts run with cfg which
+// are not in PATH
+func missingPrograms(cfg Config) []string {
+	requiredProgs := []string{"openshift-install"}
+
+	if len(cfg.Helm.Chart) > 0 {
+		requiredProgs = append(requiredProgs, "helm", "oc", "git")
+	}
+
+	if cfg.Health.Probe {
+		requiredProgs = append(requiredProgs, "oc")
+	}
+
+	missingProgs := []string{}
+	for _, prog := range requiredProgs {
+		if _, err := exec.LookPath(prog); err != nil {
+			missingProgs = append(missingProgs, prog)
+		}
+	}
+
+	return missingProgs
+}
+
+// checkConfig validates parts of the configuration which cannot be validated
+// with struct tags
+func checkConfig(cfg Config) error {
+	if err := prepareStateStore(cfg.OpenShiftInstall.StateStorePath); err != nil {
+		return fmt.Errorf("failed to prepare OpenShiftInstall.StateStorePath %s: %s",
+			cfg.OpenShiftInstall.StateStorePath, err.Error())
+	}
+
+	if len(cfg.OpenShiftInstall.WorkDir) > 0 {
+		if err := prepareStateStore(cfg.OpenShiftInstall.WorkDir); err != nil {
+			return fmt.Errorf("failed to prepare OpenShiftInstall.WorkDir %s: %s",
+				cfg.OpenShiftInstall.WorkDir, err.Error())
+		}
+	}
+
+	if _, err := checkFreeSpace(cfg); err != nil {
+		return err
+	}
+
+	if err := checkPullSecret(pullSecretPath(cfg)); err != nil {
+		return fmt.Errorf("invalid pull secret file %s, set by "+
+			"OpenShiftInstall.PullSecretPath: %s", pullSecretPath(cfg), err.Error())
+	}
+
+	if cfg.Health.Probe && cfg.Health.ProbeTimeout <= 0 {
+		return fmt.Errorf("Health.ProbeTimeout must be greater than 0 when " +
+			"Health.Probe is true")
+	}
+
+	for key := range cfg.OpenShiftInstall.Env {
+		if !envKeyExp.MatchString(key) {
+			return fmt.Errorf("OpenShiftInstall.Env key \"%s\" is not a valid "+
+				"environment variable name", key)
+		}
+	}
+
+	for key, value := range cfg.OpenShiftInstall.UserTags {
+		if len(key) == 0 || strings.ContainsAny(key, ",="+unquotableTagChars) ||
+			strings.ContainsAny(value, ","+unquotableTagChars) {
+
+			return fmt.Errorf("OpenShiftInstall.UserTags tag \"%s=%s\" is invalid, "+
+				"keys cannot be empty or contain commas or equals signs, keys and "+
+				"values cannot contain commas, double quotes, backslashes, or "+
+				"newlines", key, value)
+		}
+	}
+
+	envTagKey, envTagValue, err := environmentTag(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid Cluster.EnvironmentTag: %s", err.Error())
+	}
+
+	// userTags are the tags clusters will be created with
+	userTags := cfg.OpenShiftInstall.UserTags
+
+	if len(cfg.OpenShiftInstall.BaseInstallConfigPath) > 0 {
+		baseInstallCfg, err := loadBaseInstallConfig(
+			cfg.OpenShiftInstall.BaseInstallConfigPath)
+		if err != nil {
+			return fmt.Errorf("invalid OpenShiftInstall.BaseInstallConfigPath %s: %s",
+				cfg.OpenShiftInstall.BaseInstallConfigPath, err.Error())
+		}
+
+		userTags = installConfigUserTags(baseInstallCfg)
+	}
+
+	// Clusters without the environment tag would not be found after creation.
+	// Clusters created with a generated configuration always have it.
+	if len(envTagKey) > 0 && len(cfg.OpenShiftInstall.BaseInstallConfigPath) > 0 &&
+		userTags[envTagKey] != envTagValue {
+
+		return fmt.Errorf("OpenShiftInstall.BaseInstallConfigPath platform.aws.userTags "+
+			"must include the Cluster.EnvironmentTag tag %s=%s", envTagKey, envTagValue)
+	}
+
+	for _, key := range cfg.OpenShiftInstall.RequiredTags {
+		if len(userTags[key]) == 0 {
+			return fmt.Errorf("clusters would be created without the \"%s\" tag, "+
+				"which is in OpenShiftInstall.RequiredTags", key)
+		}
+	}
+
+	for _, subnet := range cfg.OpenShiftInstall.Subnets {
+		if !strings.HasPrefix(subnet, "subnet-") {
+			return fmt.Errorf("OpenShiftInstall.Subnets subnet \"%s\" is not a "+
+				"subnet ID, must start with \"subnet-\"", subnet)
+		}
+	}
+
+	if cfg.OpenShiftInstall.Publish == "Internal" &&
+		len(cfg.OpenShiftInstall.Subnets) == 0 &&
+		len(cfg.OpenShiftInstall.BaseInstallConfigPath) == 0 {
+		return fmt.Errorf("OpenShiftInstall.Publish is Internal, so " +
+			"OpenShiftInstall.Subnets must be set to subnets in an existing VPC")
+	}
+
+	if len(cfg.Audit.LogPath) > 0 {
+		f, err := os.OpenFile(cfg.Audit.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+			0600)
+		if err != nil {
+			return fmt.Errorf("cannot open Audit.LogPath %s: %s", cfg.Audit.LogPath,
+				err.Error())
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close Audit.LogPath %s: %s", cfg.Audit.LogPath,
+				err.Error())
+		}
+	}
+
+	if len(cfg.OpenShiftInstall.AdditionalTrustBundlePath) > 0 {
+		if err := checkTrustBundle(cfg.OpenShiftInstall.AdditionalTrustBundlePath); err != nil {
+			return fmt.Errorf("invalid OpenShiftInstall.AdditionalTrustBundlePath %s: %s",
+				cfg.OpenShiftInstall.AdditionalTrustBundlePath, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkConsole checks a cluster's web console responds over HTTPS, using the
+// console URL from its state directory. The certificate is not verified since
+// clusters use self signed certificates by default.
+func checkConsole(logger *log.Logger, cfg Config, clusterName string) error {
+	creds, err := readClusterCredentials(cfg, clusterName)
+	if err != nil {
+		return fmt.Errorf("failed to get console URL: %s", err.Error())
+	}
+
+	if len(creds.ConsoleURL) == 0 {
+		return fmt.Errorf("console URL unknown")
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(cfg.Health.ConsoleCheckTimeout * float64(time.Second)),
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	return retryBackoff(logger, fmt.Sprintf("check console of cluster %s",
+		clusterName), cfg.Health.ConsoleCheckAttempts, time.Second*5,
+		func() error {
+			resp, err := client.Get(creds.ConsoleURL)
+			if err != nil {
+				return fmt.Errorf("failed to request %s: %s", creds.ConsoleURL,
+					err.Error())
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode >= 400 {
+				return fmt.Errorf("%s responded with status %d", creds.ConsoleURL,
+					resp.StatusCode)
+			}
+
+			return nil
+		})
+}
+
+// environmentTag returns the key and value of Config.Cluster.EnvironmentTag, both
+// empty if it is not set
+func environmentTag(cfg Config) (string, string, error) {
+	if len(cfg.Cluster.EnvironmentTag) == 0 {
+		return "", "", nil
+	}
+
+	parts := strings.SplitN(cfg.Cluster.EnvironmentTag, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 ||
+		strings.ContainsAny(cfg.Cluster.EnvironmentTag, ","+unquotableTagChars) {
+
+		return "", "", fmt.Errorf("\"%s\" must be in the format key=value, and "+
+			"cannot contain commas, double quotes, backslashes, or newlines",
+			cfg.Cluster.EnvironmentTag)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// unquotableTagChars are characters tags cannot contain, the
+// openshift-install-create-config.yaml.sh script puts tags in double quoted YAML
+// strings without escaping them
+const unquotableTagChars = "\"\\\n\r"
+
+// ec2InstanceFilters returns sets of filters for describing EC2 instances which
+// only match instances which could be part of managed clusters. An instance is
+// matched if it matches any of the sets.
+func ec2InstanceFilters(cfg Config, flags Flags) [][]*ec2Svc.Filter {
+	states := []string{"pending", "running"}
+
+	// Instances which are not running must be found to know their clusters are
+	// not fully running
+	if cfg.Cluster.RequireRunning {
+		states = append(states, "shutting-down", "stopping", "stopped")
+	}
+
+	filters := []*ec2Svc.Filter{
+		{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(states),
+		},
+	}
+
+	if cfg.Cluster.RequireManagedTag {
+		filters = append(filters, &ec2Svc.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", ManagedTagKey)),
+			Values: aws.StringSlice([]string{"true"}),
+		})
+	}
+
+	// Clusters of other environments are never found, even as orphans
+	if envTagKey, envTagValue, _ := environmentTag(cfg); len(envTagKey) > 0 {
+		filters = append(filters, &ec2Svc.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", envTagKey)),
+			Values: aws.StringSlice([]string{envTagValue}),
+		})
+	}
+
+	// Orphaned clusters do not match the name prefix
+	if flags.ReapOrphans {
+		return [][]*ec2Svc.Filter{filters}
+	}
+
+	// Match instances by Name tag or by cluster owned tag, which is present
+	// even if the Name tag is not
+	nameFilters := append([]*ec2Svc.Filter{{
+		Name:   aws.String("tag:Name"),
+		Values: aws.StringSlice([]string{cfg.Cluster.NamePrefix + "*"}),
+	}}, filters...)
+
+	ownedFilters := append([]*ec2Svc.Filter{{
+		Name: aws.String("tag-key"),
+		Values: aws.StringSlice([]string{
+			ClusterOwnedTagPrefix + cfg.Cluster.NamePrefix + "*",
+		}),
+	}}, filters...)
+
+	return [][]*ec2Svc.Filter{nameFilters, ownedFilters}
+}
+
+// infraInstanceFilters returns filters for describing the EC2 instances, which
+// are not terminated, of the cluster with the infrastructure ID infraID. Unlike
+// ec2InstanceFilters instances are matched even if they are stopped or not
+// managed.
+func infraInstanceFilters(infraID string) []*ec2Svc.Filter {
+	return []*ec2Svc.Filter{
+		{
+			Name:   aws.String("tag-key"),
+			Values: aws.StringSlice([]string{ClusterOwnedTagPrefix + infraID}),
+		},
+		{
+			Name: aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "shutting-down",
+				"stopping", "stopped"}),
+		},
+	}
+}
+
+// ec2InstanceName returns the value of an EC2 instance's Name tag, and the
+// infrastructure ID from its cluster owned tag. Either is empty if the tag
+// is not present.
+func ec2InstanceName(instance *ec2Svc.Instance) (string, string) {
+	name := ""
+	infraID := ""
+
+	for _, tag := range instance.Tags {
+		if tag.Key == nil || tag.Value == nil {
+			continue
+		}
+
+		if *tag.Key == "Name" {
+			name = *tag.Value
+		} else if strings.HasPrefix(*tag.Key, ClusterOwnedTagPrefix) &&
+			*tag.Value == "owned" {
+
+			infraID = strings.TrimPrefix(*tag.Key, ClusterOwnedTagPrefix)
+		}
+	}
+
+	return name, infraID
+}
+
+// InstanceGrouper groups EC2 instances into clusters. Instances are grouped as
+// each page is described, so all instances are not held at once.
+type InstanceGrouper struct {
+	// Clusters found, keys are cluster names
+	Clusters map[string]Cluster
+
+	// Orphans are instances of clusters created by this program which do not
+	// match Config.Cluster.NamePrefix, only found if Flags.ReapOrphans
+	Orphans []EC2Instance
+
+	logger *log.Logger
+	cfg    Config
+	flags  Flags
+
+	// recordsCluster is the name of the cluster DNS records point to
+	recordsCluster string
+
+	// now returns the current time, used to calculate cluster ages
+	now func() time.Time
+
+	// envTagKey and envTagValue are the parts of Config.Cluster.EnvironmentTag
+	envTagKey   string
+	envTagValue string
+
+	// infraIDs are the infrastructure IDs of clusters, keys are cluster names
+	infraIDs map[string]string
+
+	// seen holds the IDs of instances already added, since instances can be
+	// found by more than one set of filters
+	seen map[string]bool
+}
+
+// NewInstanceGrouper creates an InstanceGrouper
+func NewInstanceGrouper(logger *log.Logger, cfg Config, flags Flags,
+	recordsCluster string, now func() time.Time) *InstanceGrouper {
+
+	envTagKey, envTagValue, _ := environmentTag(cfg)
+
+	return &InstanceGrouper{
+		Clusters:       map[string]Cluster{},
+		Orphans:        []EC2Instance{},
+		logger:         logger,
+		cfg:            cfg,
+		flags:          flags,
+		recordsCluster: recordsCluster,
+		now:            now,
+		envTagKey:      envTagKey,
+		envTagValue:    envTagValue,
+		infraIDs:       map[string]string{},
+		seen:           map[string]bool{},
+	}
+}
+
+// Add adds a described EC2 instance to its cluster, or to Orphans. Instances
+// which are not part of managed clusters are skipped.
+func (g *InstanceGrouper) Add(instance *ec2Svc.Instance) {
+	// Ensure is running
+	// See state code documentation: https://docs.aws.amazon.com/sdk-for-go/api/service/ec2/#InstanceState
+	// state code 16 is running, anything past running
+	// we want to ignore, unless Config.Cluster.RequireRunning
+	// in which case it is recorded
+	if *instance.State.Code > int64(16) && !g.cfg.Cluster.RequireRunning {
+		return
+	}
+	running := *instance.State.Name == "running"
+
+	if g.seen[*instance.InstanceId] {
+		return
+	}
+	g.seen[*instance.InstanceId] = true
+
+	// Check if instance should be ignored
+	ignored := false
+	managed := false
+	envTagged := len(g.envTagKey) == 0
+	expiresAt := time.Time{}
+	for _, tag := range instance.Tags {
+		key := aws.StringValue(tag.Key)
+		value := aws.StringValue(tag.Value)
+
+		if key == g.envTagKey && value == g.envTagValue {
+			envTagged = true
+		}
+
+		if key == IgnoreTagKey && value == "true" {
+			ignored = true
+		}
+
+		if key == ManagedTagKey && value == "true" {
+			managed = true
+		}
+
+		if key == ExpiresAtTagKey {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				g.logger.Printf("WARNING: ignoring invalid %s tag on "+
+					"instance %s, must be an RFC 3339 time: %s",
+					ExpiresAtTagKey, *instance.InstanceId, err.Error())
+			} else {
+				expiresAt = t
+			}
+		}
+	}
+
+	if g.cfg.Cluster.RequireManagedTag && !managed {
+		return
+	}
+
+	if !envTagged {
+		return
+	}
+
+	// Determine name from Name tag, if the Name tag is
+	// missing or does not match use the infrastructure ID
+	// from the cluster owned tag
+	instanceName, infraID := ec2InstanceName(instance)
+
+	// If name matches cluster prefix
+	if strings.HasPrefix(instanceName, g.cfg.Cluster.NamePrefix) {
+		ec2Instance := EC2Instance{
+			Name:      instanceName,
+			CreatedOn: *instance.LaunchTime,
+			Ignored:   ignored,
+			InfraID:   infraID,
+			ExpiresAt: expiresAt,
+			Running:   running,
+		}
+		g.group(ec2Instance)
+
+		g.logger.Printf("found AWS EC2 instance: %s", ec2Instance.String())
+	} else if strings.HasPrefix(infraID, g.cfg.Cluster.NamePrefix) {
+		ec2Instance := EC2Instance{
+			Name:      infraID,
+			CreatedOn: *instance.LaunchTime,
+			Ignored:   ignored,
+			InfraID:   infraID,
+			ExpiresAt: expiresAt,
+			Running:   running,
+		}
+		g.group(ec2Instance)
+
+		g.logger.Printf("found AWS EC2 instance without matching Name tag "+
+			"using cluster owned tag: %s", ec2Instance.String())
+	} else if g.flags.ReapOrphans && managed && !ignored &&
+		len(instanceName) > 0 {
+
+		ec2Instance := EC2Instance{
+			Name:      instanceName,
+			CreatedOn: *instance.LaunchTime,
+			Running:   running,
+		}
+		g.Orphans = append(g.Orphans, ec2Instance)
+
+		g.logger.Printf("found orphaned AWS EC2 instance: %s",
+			ec2Instance.String())
+	}
+}
+
+// group adds an instance whose name matches Config.Cluster.NamePrefix to its
+// cluster in Clusters
+func (g *InstanceGrouper) group(instance EC2Instance) {
+	// Get cluster name from instance name
+	parts := strings.Split(instance.Name, "-")
+
+	i := 0
+	clusterName := ""
+
+	for !strings.HasPrefix(clusterName, g.cfg.Cluster.NamePrefix) && i < len(parts) {
+		clusterName = strings.Join(parts[:i], "-")
+		i += 1
+	}
+
+	if !strings.HasPrefix(clusterName, g.cfg.Cluster.NamePrefix) {
+		g.logger.Printf("WARNING: not managing instance %s, it was selected as "+
+			"part of a cluster but its cluster name could not be extracted",
+			instance.Name)
+		return
+	}
+
+	// Detect different clusters with the same name
+	// The cluster which owns the name is the one whose infrastructure ID
+	// is in the name's state directory, or the first one found
+	ownerInfraID, ok := g.infraIDs[clusterName]
+	if !ok {
+		ownerInfraID = stateInfraID(g.cfg, clusterName)
+	}
+	if len(ownerInfraID) == 0 {
+		ownerInfraID = instance.InfraID
+	}
+	g.infraIDs[clusterName] = ownerInfraID
+
+	// Clusters which do not own their name are keyed by their
+	// infrastructure ID instead
+	clusterKey := clusterName
+	if len(instance.InfraID) > 0 && instance.InfraID != ownerInfraID {
+		clusterKey = instance.InfraID
+	}
+
+	if err := validClusterName(clusterKey); err != nil {
+		g.logger.Printf("WARNING: not managing instance %s, its cluster name "+
+			"\"%s\" is invalid: %s", instance.Name, clusterKey, err.Error())
+		return
+	}
+
+	// Determine infrastructure ID
+	infraID := instance.InfraID
+	if clusterKey == clusterName && len(ownerInfraID) > 0 {
+		infraID = ownerInfraID
+	} else if len(infraID) == 0 {
+		infraID = infraIDFromName(instance.Name, clusterName)
+	}
+
+	// Create cluster
+	if cluster, ok := g.Clusters[clusterKey]; ok {
+		if instance.Ignored {
+			cluster.Ignored = true
+		}
+		if !instance.ExpiresAt.IsZero() && (cluster.ExpiresAt.IsZero() ||
+			instance.ExpiresAt.Before(cluster.ExpiresAt)) {
+			cluster.ExpiresAt = instance.ExpiresAt
+		}
+		if len(cluster.InfraID) == 0 {
+			cluster.InfraID = infraID
+		}
+		if !instance.Running {
+			cluster.Running = false
+		}
+		g.Clusters[clusterKey] = cluster
+		return
+	}
+
+	if clusterKey != clusterName {
+		g.logger.Printf("WARNING: found cluster with infrastructure ID %s "+
+			"which has the same name as the cluster with infrastructure ID "+
+			"%s: %s, ignoring it since it cannot be managed by name",
+			clusterKey, ownerInfraID, clusterName)
+	}
+
+	g.Clusters[clusterKey] = Cluster{
+		Name:             clusterKey,
+		Age:              g.now().Sub(instance.CreatedOn),
+		DNSPointed:       clusterKey == g.recordsCluster,
+		Healthy:          true,
+		Ignored:          instance.Ignored || clusterKey != clusterName,
+		InfraID:          infraID,
+		ExpiresAt:        instance.ExpiresAt,
+		Running:          instance.Running,
+		ConsoleReachable: true,
+	}
+}
+
+// awsRegion is the AWS region clusters are created in
+const awsRegion = "us-east-1"
+
+// validateZones returns an error if any of zones are not available AWS availability
+// zones in awsRegion
+func validateZones(ec2 *ec2Svc.EC2, zones []string) error {
+	if len(zones) == 0 {
+		return nil
+	}
+
+	resp, err := ec2.DescribeAvailabilityZones(&ec2Svc.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return fmt.Errorf("failed to describe AWS availability zones: %s", err.Error())
+	}
+
+	available := map[string]bool{}
+	for _, zone := range resp.AvailabilityZones {
+		available[*zone.ZoneName] = *zone.State == "available"
+	}
+
+	for _, zone := range zones {
+		ok, exists := available[zone]
+		if !exists {
+			return fmt.Errorf("zone %s is not in the %s region", zone, awsRegion)
+		}
+
+		if !ok {
+			return fmt.Errorf("zone %s is not available", zone)
+		}
+	}
+
+	return nil
+}
+
+// installConfigEnv returns environment variables for the run-openshift-install.sh
+// script which configure the generated openshift-install configuration file
+func installConfigEnv(cfg Config) []string {
+	env := installEnv(cfg)
+
+	userTags := fmt.Sprintf("%s=true,%s=%s", ManagedTagKey, VersionTagKey, version)
+	for _, key := range sortedKeys(cfg.OpenShiftInstall.UserTags) {
+		userTags += fmt.Sprintf(",%s=%s", key, cfg.OpenShiftInstall.UserTags[key])
+	}
+	if len(cfg.Cluster.EnvironmentTag) > 0 {
+		userTags += "," + cfg.Cluster.EnvironmentTag
+	}
+	if cfg.Cluster.TTL > 0 {
+		expiresAt := time.Now().Add(time.Duration(cfg.Cluster.TTL * float64(time.Hour)))
+		userTags += fmt.Sprintf(",%s=%s", ExpiresAtTagKey,
+			expiresAt.UTC().Format(time.RFC3339))
+	}
+	env = append(env, fmt.Sprintf("AUTO_CLUSTER_USER_TAGS=%s", userTags))
+
+	env = append(env, fmt.Sprintf("AUTO_CLUSTER_PULL_SECRET_PATH=%s",
+		pullSecretPath(cfg)))
+
+	if len(cfg.OpenShiftInstall.Zones) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_ZONES=%s",
+			strings.Join(cfg.OpenShiftInstall.Zones, ",")))
+	}
+
+	if len(cfg.OpenShiftInstall.Subnets) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_SUBNETS=%s",
+			strings.Join(cfg.OpenShiftInstall.Subnets, ",")))
+	}
+
+	// External is the installer's default, leave it out for installers which do
+	// not know the publish key
+	if cfg.OpenShiftInstall.Publish != "External" {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_PUBLISH=%s",
+			cfg.OpenShiftInstall.Publish))
+	}
+
+	if len(cfg.OpenShiftInstall.HTTPProxy) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_HTTP_PROXY=%s",
+			cfg.OpenShiftInstall.HTTPProxy))
+	}
+
+	if len(cfg.OpenShiftInstall.HTTPSProxy) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_HTTPS_PROXY=%s",
+			cfg.OpenShiftInstall.HTTPSProxy))
+	}
+
+	if len(cfg.OpenShiftInstall.NoProxy) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_NO_PROXY=%s",
+			cfg.OpenShiftInstall.NoProxy))
+	}
+
+	if len(cfg.OpenShiftInstall.CredentialsMode) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_CREDENTIALS_MODE=%s",
+			cfg.OpenShiftInstall.CredentialsMode))
+	}
+
+	if len(cfg.OpenShiftInstall.FeatureSet) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_FEATURE_SET=%s",
+			cfg.OpenShiftInstall.FeatureSet))
+	}
+
+	if len(cfg.OpenShiftInstall.AdditionalTrustBundlePath) > 0 {
+		env = append(env, fmt.Sprintf("AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH=%s",
+			cfg.OpenShiftInstall.AdditionalTrustBundlePath))
+	}
+
+	return env
+}
+
+// destroyLogLevel returns the openshift-install log level used to delete clusters
+func destroyLogLevel(cfg Config) string {
+	if len(cfg.OpenShiftInstall.DestroyLogLevel) > 0 {
+		return cfg.OpenShiftInstall.DestroyLogLevel
+	}
+
+	return cfg.OpenShiftInstall.LogLevel
+}
+
+// metadataBackupFile is the name of the copy of openshift-install's metadata.json
+// made in a cluster's state directory before the cluster is deleted
+const metadataBackupFile = "metadata.json.bak"
+
+// destroyFailedFile is the name of the file written in a cluster's state directory
+// when deleting the cluster fails
+const destroyFailedFile = "DESTROY_FAILED"
+
+// errNoMetadata is returned by backupMetadata if a cluster's state directory has
+// neither metadata.json nor metadataBackupFile
+var errNoMetadata = fmt.Errorf("neither metadata.json nor %s exist",
+	metadataBackupFile)
+
+// backupMetadata copies a cluster's metadata.json to metadataBackupFile, which
+// openshift-install needs to delete the cluster. If metadata.json does not exist
+// but the backup does, ex., because a failed delete removed it, the backup is
+// restored instead. Returns errNoMetadata if neither exist.
+func backupMetadata(cfg Config, clusterName string) error {
+	dir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, clusterName)
+	metadataPath := filepath.Join(dir, "metadata.json")
+	backupPath := filepath.Join(dir, metadataBackupFile)
+
+	src, dst := metadataPath, backupPath
+	if _, err := os.Stat(metadataPath); os.IsNotExist(err) {
+		if _, err := os.Stat(backupPath); err != nil {
+			return errNoMetadata
+		}
+		src, dst = backupPath, metadataPath
+	}
+
+	metadata, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", src, err.Error())
+	}
+
+	if err := ioutil.WriteFile(dst, metadata, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %s", dst, err.Error())
+	}
+
+	return nil
+}
+
+// writeDestroyFailed writes destroyFailedFile in a cluster's state directory,
+// describing why deleting the cluster failed and how to retry
+func writeDestroyFailed(cfg Config, clusterName string, attempts uint,
+	destroyErr error) error {
+
+	dir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, clusterName)
+	msg := fmt.Sprintf("Deleting cluster %s failed at %s after %d attempt(s): %s\n\n"+
+		"Some of the cluster's AWS resources may still exist. openshift-install's\n"+
+		"output is in destroy.log. To retry run:\n\n"+
+		"    cp %s metadata.json # if metadata.json does not exist\n"+
+		"    openshift-install destroy cluster --dir %s\n",
+		clusterName, time.Now().UTC().Format(time.RFC3339), attempts,
+		destroyErr.Error(), metadataBackupFile, dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, destroyFailedFile), []byte(msg),
+		0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", destroyFailedFile, err.Error())
+	}
+
+	return nil
+}
+
+// installIdleTimeout returns Config.OpenShiftInstall.IdleTimeout as a duration
+func installIdleTimeout(cfg Config) time.Duration {
+	return time.Duration(cfg.OpenShiftInstall.IdleTimeout * float64(time.Minute))
+}
+
+// hookEnv returns the environment in which hooks for a cluster are run
+func hookEnv(cfg Config, cluster Cluster) []string {
+	stateDir := filepath.Join(cfg.OpenShiftInstall.StateStorePath, cluster.Name)
+
+	return append(os.Environ(),
+		fmt.Sprintf("AUTO_CLUSTER_NAME=%s", cluster.Name),
+		fmt.Sprintf("AUTO_CLUSTER_INFRA_ID=%s", cluster.InfraID),
+		fmt.Sprintf("AUTO_CLUSTER_STATE_DIR=%s", stateDir),
+		fmt.Sprintf("AUTO_CLUSTER_KUBECONFIG=%s",
+			filepath.Join(stateDir, "auth", "kubeconfig")))
+}
+
+// runHook runs a hook command for a cluster with "sh -c"
+func runHook(logger *log.Logger, cfg Config, name, hook string, cluster Cluster) error {
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Env = hookEnv(cfg, cluster)
+
+	return runCmd(loggerChild(logger, name+".stdout"),
+		loggerChild(logger, name+".stderr"), cmd, 0,
+		time.Duration(cfg.Hooks.Timeout*float64(time.Minute)))
+}
+
+// envKeyExp matches valid environment variable names
+var envKeyExp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// installEnv returns the environment in which openshift-install is run, the
+// program's environment with Config.OpenShiftInstall.Env set
+func installEnv(cfg Config) []string {
+	env := os.Environ()
+
+	for _, key := range installEnvKeys(cfg) {
+		env = append(env, fmt.Sprintf("%s=%s", key, cfg.OpenShiftInstall.Env[key]))
+	}
+
+	return env
+}
+
+// installEnvKeys returns the sorted keys of Config.OpenShiftInstall.Env
+func installEnvKeys(cfg Config) []string {
+	return sortedKeys(cfg.OpenShiftInstall.Env)
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// pullSecretExp matches the pull secret in an openshift-install configuration file
+var pullSecretExp = regexp.MustCompile("(?m)^pullSecret:.*$")
+
+// urlUserInfoExp matches the user information, which can contain a password, in URLs
+var urlUserInfoExp = regexp.MustCompile("://[^/@\\s]+@")
+
+// requiredInstallConfigKeys are the top level keys which an openshift-install
+// configuration file must have
+var requiredInstallConfigKeys = []string{"apiVersion", "baseDomain", "metadata",
+	"platform", "pullSecret"}
+
+// loadBaseInstallConfig reads an openshift-install configuration file and checks
+// that it has the required keys
+func loadBaseInstallConfig(path string) (yaml.MapSlice, error) {
+	installCfgBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %s", err.Error())
+	}
+
+	return parseInstallConfig(installCfgBytes)
+}
+
+// parseInstallConfig parses an openshift-install configuration file and checks
+// that it has the required keys
+func parseInstallConfig(installCfgBytes []byte) (yaml.MapSlice, error) {
+	installCfg := yaml.MapSlice{}
+	if err := yaml.Unmarshal(installCfgBytes, &installCfg); err != nil {
+		return nil, fmt.Errorf("failed to parse as YAML: %s", err.Error())
+	}
+
+	for _, key := range requiredInstallConfigKeys {
+		found := false
+		for _, item := range installCfg {
+			if item.Key == key {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("missing required key \"%s\"", key)
+		}
+	}
+
+	return installCfg, nil
+}
+
+// installConfigUserTags returns the platform.aws.userTags of an openshift-install
+// configuration file
+func installConfigUserTags(installCfg yaml.MapSlice) map[string]string {
+	userTags := map[string]string{}
+
+	// mapValue returns the value of key in m, nil if m is not a map or key is
+	// not present
+	mapValue := func(m interface{}, key string) interface{} {
+		items, ok := m.(yaml.MapSlice)
+		if !ok {
+			return nil
+		}
+
+		for _, item := range items {
+			if item.Key == key {
+				return item.Value
+			}
+		}
+
+		return nil
+	}
+
+	tags, ok := mapValue(mapValue(mapValue(installCfg, "platform"), "aws"),
+		"userTags").(yaml.MapSlice)
+	if !ok {
+		return userTags
+	}
+
+	for _, tag := range tags {
+		userTags[fmt.Sprintf("%v", tag.Key)] = fmt.Sprintf("%v", tag.Value)
+	}
+
+	return userTags
+}
+
+// baseInstallConfig returns the Config.OpenShiftInstall.BaseInstallConfigPath
+// openshift-install configuration file with metadata.name set to clusterName. If
+// redact is true the pull secret is redacted.
+func baseInstallConfig(cfg Config, clusterName string, redact bool) ([]byte, error) {
+	installCfg, err := loadBaseInstallConfig(cfg.OpenShiftInstall.BaseInstallConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range installCfg {
+		switch item.Key {
+		case "metadata":
+			metadata, ok := item.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("metadata key is not a map")
+			}
+
+			named := yaml.MapSlice{{Key: "name", Value: clusterName}}
+			for _, metadataItem := range metadata {
+				if metadataItem.Key != "name" {
+					named = append(named, metadataItem)
+				}
+			}
+			installCfg[i].Value = named
+		case "pullSecret":
+			if redact {
+				installCfg[i].Value = "REDACTED"
+			}
+		}
+	}
+
+	out, err := yaml.Marshal(installCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal as YAML: %s", err.Error())
+	}
+
+	return out, nil
+}
+
+// writeBaseInstallConfig writes the Config.OpenShiftInstall.BaseInstallConfigPath
+// openshift-install configuration file for a cluster to a temporary file, and
+// returns its path. The caller must remove the file.
+func writeBaseInstallConfig(cfg Config, clusterName string) (string, error) {
+	out, err := baseInstallConfig(cfg, clusterName, false)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "install-config-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %s", err.Error())
+	}
+
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary file: %s", err.Error())
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to close temporary file: %s", err.Error())
+	}
+
+	return f.Name(), nil
+}
+
+// renderInstallConfig runs the openshift-install-create-config.yaml.sh script to
+// generate an openshift-install configuration file for a cluster, or uses
+// Config.OpenShiftInstall.BaseInstallConfigPath if set. The pull secret is
+// redacted from the returned configuration file.
+func renderInstallConfig(script string, cfg Config, clusterName string) (string, error) {
+	if len(cfg.OpenShiftInstall.BaseInstallConfigPath) > 0 {
+		out, err := baseInstallConfig(cfg, clusterName, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to render %s: %s",
+				cfg.OpenShiftInstall.BaseInstallConfigPath, err.Error())
+		}
+
+		return urlUserInfoExp.ReplaceAllString(string(out), "://REDACTED@"), nil
+	}
+
+	cmd := exec.Command(script, clusterName)
+	cmd.Dir = cfg.OpenShiftInstall.StateStorePath
+	cmd.Env = installConfigEnv(cfg)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("failed to run script: %s: %s", err.Error(),
+				strings.TrimSpace(string(exitErr.Stderr)))
+		}
+
+		return "", fmt.Errorf("failed to run script: %s", err.Error())
+	}
+
+	redacted := pullSecretExp.ReplaceAllString(string(out), "pullSecret: REDACTED")
+	redacted = urlUserInfoExp.ReplaceAllString(redacted, "://REDACTED@")
+
+	return redacted, nil
+}
+
+// awsCredsEnv adds AWS credential environment variables to env if creds is not nil.
+// This allows subprocesses to use credentials obtained by the Go program.
+func awsCredsEnv(env []string, creds *credentials.Credentials) ([]string, error) {
+	if creds == nil {
+		return env, nil
+	}
+
+	value, err := creds.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %s", err.Error())
+	}
+
+	return append(env,
+		fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", value.AccessKeyID),
+		fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", value.SecretAccessKey),
+		fmt.Sprintf("AWS_SESSION_TOKEN=%s", value.SessionToken)), nil
+}
+
+// runCmd runs a command as a subprocess, handles printing out stdout and stderr.
+// Kubeadmin passwords printed by openshift-install are redacted from output.
+// Errors reading output are logged and returned after the command completes. If
+// idleTimeout is not zero and the command does not output a line for idleTimeout
+// the command and its children are killed and a stalled error is returned. If
+// timeout is not zero and the command runs for longer than timeout it is killed
+// and a timed out error is returned. Both only apply until the command and its
+// children close their output, which they do when they exit.
+func runCmd(stdoutLogger, stderrLogger *log.Logger, cmd *exec.Cmd,
+	idleTimeout, timeout time.Duration) error {
+
+	// Put command in its own process group so its children can be killed if it
+	// stalls, otherwise they would keep its output open
+	if idleTimeout > 0 || timeout > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %s", err.Error())
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stderr pipe: %s", err.Error())
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start command: %s", err.Error())
+	}
+
+	// readErrs receives an error, or nil, from each output reader when it is done
+	readErrs := make(chan error, 2)
+
+	// activity receives a value when the command outputs a line
+	activity := make(chan struct{}, 1)
+
+	logOutput := func(name string, r io.Reader, logger *log.Logger) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			logger.Print(redactInstallPassword(scanner.Text()))
+
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			logger.Printf("failed to read %s: %s", name, err.Error())
+
+			// Keep draining so the command does not block writing output
+			io.Copy(ioutil.Discard, r)
+
+			readErrs <- fmt.Errorf("failed to read %s: %s", name, err.Error())
+			return
+		}
+
+		readErrs <- nil
+	}
+
+	go logOutput("stdout", stdout, stdoutLogger)
+	go logOutput("stderr", stderr, stderrLogger)
+
+	// Kill command if it stalls or times out. done is closed once all output is
+	// read.
+	done := make(chan struct{})
+
+	// killed receives why the command was killed, empty if it was not
+	killed := make(chan string, 1)
+
+	kill := func(reason string) {
+		stderrLogger.Printf("%s, killing command", reason)
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			stderrLogger.Printf("failed to kill command: %s", err.Error())
+		}
+		killed <- reason
+	}
+
+	// drained returns true, and reports the command was not killed, if its output
+	// was drained while a timer fired, in which case the command already exited
+	drained := func() bool {
+		select {
+		case <-done:
+			killed <- ""
+			return true
+		default:
+			return false
+		}
+	}
+
+	go func() {
+		// A nil channel never receives, disabling its select case
+		var idleC, timeoutC <-chan time.Time
+
+		var idleTimer *time.Timer
+		if idleTimeout > 0 {
+			idleTimer = time.NewTimer(idleTimeout)
+			defer idleTimer.Stop()
+			idleC = idleTimer.C
+		}
+
+		if timeout > 0 {
+			timeoutTimer := time.NewTimer(timeout)
+			defer timeoutTimer.Stop()
+			timeoutC = timeoutTimer.C
+		}
+
+		for {
+			select {
+			case <-done:
+				killed <- ""
+				return
+			case <-activity:
+				if idleTimer != nil {
+					if !idleTimer.Stop() {
+						<-idleTimer.C
+					}
+					idleTimer.Reset(idleTimeout)
+				}
+			case <-idleC:
+				if drained() {
+					return
+				}
+				kill(fmt.Sprintf("command stalled, no output for %s",
+					idleTimeout.String()))
+				return
+			case <-timeoutC:
+				if drained() {
+					return
+				}
+				kill(fmt.Sprintf("command timed out after %s", timeout.String()))
+				return
+			}
+		}
+	}()
+
+	// All output must be read before waiting for the command
+	var readErr error
+	for i := 0; i < 2; i++ {
+		if err := <-readErrs; err != nil && readErr == nil {
+			readErr = err
+		}
+	}
+
+	// Output is drained once the command and its children exited or closed their
+	// output, stop the timers so they cannot fire while waiting
+	close(done)
+	reason := <-killed
+
+	waitErr := cmd.Wait()
+
+	if len(reason) > 0 {
+		return fmt.Errorf("%s", reason)
+	}
+
+	if waitErr != nil {
+		return fmt.Errorf("failed to wait for command to complete: %s", waitErr.Error())
+	}
+
+	if readErr != nil {
+		return fmt.Errorf("command completed but its output could not be read: %s",
+			readErr.Error())
+	}
+
+	return nil
+}
+
+func main() {
+	// {{{1 Initial setup
+	// {{{2 Random
+	// Seeded before anything else runs, loop IDs and retry backoffs use it
+	rand.Seed(time.Now().UnixNano())
+
+	// {{{2 Logger
+	logger := log.New(os.Stdout, "auto-cluster ", log.Ldate|log.Ltime)
+
+	logger.Printf("auto-cluster %s", buildInfo())
+
+	// {{{2 Graceful exit
+	ctx, cancelCtx := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+
+	go func() {
+		<-sigs
+		cancelCtx()
+		logger.Print("received interrupt signal, will exit gracefully at the " +
+			"end of the next controll loop execution")
+	}()
+
+	// {{{2 Command line arguments
+	flags := Flags{}
+	flag.BoolVar(&flags.Once, "once", false, "run control loop once and exit")
+	flag.BoolVar(&flags.DryRun, "dry-run", false, "do not perform actions")
+	flag.BoolVar(&flags.NoDNS, "no-dns", false, "do not modify DNS")
+	flag.StringVar(&flags.LogFormat, "log-format", "text",
+		"format of log output, \"text\" or \"json\"")
+	flag.BoolVar(&flags.ReapOrphans, "reap-orphans", false,
+		"delete clusters created by this tool which no longer match Cluster.NamePrefix")
+	flag.BoolVar(&flags.DetectDrift, "detect-drift", false,
+		"run control loop once without performing actions, exit with status 1 if "+
+			"clusters would be created or deleted")
+	flag.BoolVar(&flags.ExplainPrimary, "explain-primary", false,
+		"run control loop once without performing actions, print why each "+
+			"cluster is or is not the primary cluster")
+	flag.BoolVar(&flags.MetricsSnapshot, "metrics-snapshot", false,
+		"run control loop once without performing actions, print metrics in the "+
+			"OpenMetrics text format and exit")
+	flag.BoolVar(&flags.RotatePrimary, "rotate-primary", false,
+		"run control loop once, replacing the primary cluster with a new cluster")
+	flag.BoolVar(&flags.SkipPreflight, "skip-preflight", false,
+		"do not check required programs are installed at startup")
+	flag.BoolVar(&flags.PrintConfig, "print-config", false,
+		"print the loaded configuration, with secrets redacted, and exit")
+	flag.BoolVar(&flags.PrintExampleConfig, "print-example-config", false,
+		"print an example configuration file and exit")
+	flag.StringVar(&flags.Output, "output", "",
+		"write found clusters and plans to stdout, only \"yaml\" supported")
+	flag.BoolVar(&flags.ValidateTemplate, "validate-template", false,
+		"render and check the openshift-install configuration file for the next "+
+			"cluster, print it and exit")
+	flag.BoolVar(&flags.ShowCredentials, "show-credentials", false,
+		"do not redact kubeadmin passwords in -output")
+	flag.StringVar(&flags.Import, "import", "",
+		"put the cluster with the openshift-install state directory `DIR` under "+
+			"management and exit")
+	flag.StringVar(&flags.Annotate, "annotate", "",
+		"add the KEY=VALUE annotations in the arguments to cluster `NAME` and exit")
+	flag.StringVar(&flags.Unannotate, "unannotate", "",
+		"remove the annotation KEYs in the arguments from cluster `NAME` and exit")
+	flag.BoolVar(&flags.Version, "version", false,
+		"print version and build information and exit")
+	flag.Parse()
+
+	if flags.DetectDrift || flags.ExplainPrimary || flags.MetricsSnapshot {
+		flags.Once = true
+		flags.DryRun = true
+	}
+
+	if flags.RotatePrimary {
+		flags.Once = true
+	}
+
+	// {{{3 Print version
+	if flags.Version {
+		fmt.Println(buildInfo())
+		os.Exit(0)
+	}
+
+	// {{{3 Print example configuration
+	if flags.PrintExampleConfig {
+		if err := writeExampleConfig(os.Stdout); err != nil {
+			logger.Fatalf("failed to print example configuration: %s", err.Error())
+		}
+		os.Exit(0)
+	}
+
+	// {{{3 Output
+	// logOut is where log messages are written
+	logOut := os.Stdout
+
+	switch flags.Output {
+	case "":
+		break
+	case "yaml":
+		logOut = os.Stderr
+		logger.SetOutput(logOut)
+	default:
+		logger.Fatalf("-output must be \"yaml\", was: %s", flags.Output)
+	}
+
+	if flags.MetricsSnapshot && len(flags.Output) > 0 {
+		logger.Fatalf("-metrics-snapshot and -output cannot both be used, they " +
+			"both write to stdout")
+	}
+
+	if flags.PrintConfig || flags.ExplainPrimary || flags.MetricsSnapshot ||
+		flags.ValidateTemplate {
+
+		logOut = os.Stderr
+		logger.SetOutput(logOut)
+	}
+
+	// {{{3 Log format
+	switch flags.LogFormat {
+	case "text":
+		break
+	case "json":
+		logger.SetOutput(NewJSONLogWriter(logOut))
+		logger.SetFlags(0)
+	default:
+		logger.Fatalf("-log-format must be \"text\" or \"json\", was: %s",
+			flags.LogFormat)
+	}
+
+	// {{{2 Configuration
+	cfgLdr := goconf.NewDefaultLoader()
+	for _, p := range cfgPaths {
+		cfgLdr.AddConfigPath(p)
+	}
+
+	// {{{3 Custom configuration validators
+	alphaDashExp := regexp.MustCompile("^[a-zA-Z-]*$")
+	cfgLdr.GetValidate().RegisterValidation("alphadash", func(fl validator.FieldLevel) bool {
+		return alphaDashExp.MatchString(fl.Field().String())
+	})
+
+	// {{{3 Load
+	cfg := Config{}
+	if err := cfgLdr.Load(&cfg); err != nil {
+		logger.Fatalf("failed to load configuration from %s: %s", cfgFiles(),
+			err.Error())
+	}
+
+	logger.Printf("loaded configuration from %s", cfgFiles())
+
+	for _, change := range normalizeConfig(&cfg) {
+		logger.Printf("WARNING: %s", change)
+	}
+
+	// {{{3 Print effective configuration
+	effectiveCfg := bytes.NewBuffer([]byte{})
+	if err := writeEffectiveConfig(effectiveCfg, cfg); err != nil {
+		logger.Fatalf("failed to write effective configuration: %s", err.Error())
 	}
 
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			stdoutLogger.Print(scanner.Text())
+	if flags.PrintConfig {
+		if _, err := effectiveCfg.WriteTo(os.Stdout); err != nil {
+			logger.Fatalf("failed to print configuration: %s", err.Error())
 		}
-	}()
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stderr pipe: %s", err.Error())
+		os.Exit(0)
 	}
 
+	logger.Printf("effective configuration:\n%s", effectiveCfg.String())
+
+	// {{{3 Reload on SIGHUP
+	// reloadedCfg is a new configuration which will be used starting with the
+	// next control loop execution, nil if configuration has not been reloaded
+	var reloadedCfg *Config = nil
+	reloadedCfgMutex := sync.Mutex{}
+
+	reloadSigs := make(chan os.Signal, 1)
+	signal.Notify(reloadSigs, syscall.SIGHUP)
+
 	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			stdoutLogger.Print(scanner.Text())
+		for range reloadSigs {
+			newCfg := Config{}
+			if err := cfgLdr.Load(&newCfg); err != nil {
+				logger.Printf("failed to reload configuration from %s, keeping "+
+					"current configuration: %s", cfgFiles(), err.Error())
+				continue
+			}
+
+			for _, change := range normalizeConfig(&newCfg) {
+				logger.Printf("WARNING: reloaded configuration: %s", change)
+			}
+
+			reloadedCfgMutex.Lock()
+			reloadedCfg = &newCfg
+			reloadedCfgMutex.Unlock()
+
+			logger.Print("reloaded configuration, will be used starting with " +
+				"the next control loop execution")
 		}
 	}()
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start command: %s", err.Error())
+	// {{{2 Check configuration
+	if err := checkConfig(cfg); err != nil {
+		logger.Fatalf("invalid configuration: %s", err.Error())
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for command to complete: %s", err.Error())
-	}
+	// {{{2 Annotate cluster
+	if len(flags.Annotate) > 0 || len(flags.Unannotate) > 0 {
+		if len(flags.Annotate) > 0 && len(flags.Unannotate) > 0 {
+			logger.Fatalf("-annotate and -unannotate cannot both be used")
+		}
 
-	return nil
-}
+		name := flags.Annotate
+		if len(name) == 0 {
+			name = flags.Unannotate
+		}
 
-func main() {
-	// {{{1 Initial setup
-	// {{{2 Logger
-	logger := log.New(os.Stdout, "auto-cluster ", log.Ldate|log.Ltime)
+		if err := validClusterName(name); err != nil {
+			logger.Fatalf("invalid cluster name \"%s\": %s", name, err.Error())
+		}
 
-	// {{{2 Graceful exit
-	ctx, cancelCtx := context.WithCancel(context.Background())
+		if len(flag.Args()) == 0 {
+			logger.Fatalf("no annotations provided as arguments")
+		}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+		annotations, err := readAnnotations(cfg, name)
+		if err != nil {
+			logger.Fatalf("failed to read annotations of cluster %s: %s", name,
+				err.Error())
+		}
 
-	go func() {
-		<-sigs
-		cancelCtx()
-		logger.Print("received interrupt signal, will exit gracefully at the " +
-			"end of the next controll loop execution")
-	}()
+		for _, arg := range flag.Args() {
+			if len(flags.Unannotate) > 0 {
+				delete(annotations, arg)
+				continue
+			}
 
-	// {{{2 Configuration
-	cfgLdr := goconf.NewDefaultLoader()
-	cfgLdr.AddConfigPath("/etc/auto-cluster/*.toml")
-	cfgLdr.AddConfigPath("./*.toml")
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || len(parts[0]) == 0 {
+				logger.Fatalf("annotation \"%s\" must be in the format KEY=VALUE", arg)
+			}
+			annotations[parts[0]] = parts[1]
+		}
 
-	// {{{3 Custom configuration validators
-	alphaDashExp := regexp.MustCompile("^[a-zA-Z-]*$")
-	cfgLdr.GetValidate().RegisterValidation("alphadash", func(fl validator.FieldLevel) bool {
-		return alphaDashExp.MatchString(fl.Field().String())
-	})
+		if flags.DryRun {
+			logger.Printf("would set annotations of cluster %s to: %v", name,
+				annotations)
+			os.Exit(0)
+		}
 
-	// {{{3 Load
-	cfg := Config{}
-	if err := cfgLdr.Load(&cfg); err != nil {
-		logger.Fatalf("failed to load configuration: %s", err.Error())
-	}
+		if err := writeAnnotations(cfg, name, annotations); err != nil {
+			logger.Fatalf("failed to write annotations of cluster %s: %s", name,
+				err.Error())
+		}
 
-	// {{{2 Command line arguments
-	flags := Flags{}
-	flag.BoolVar(&flags.Once, "once", false, "run control loop once and exit")
-	flag.BoolVar(&flags.DryRun, "dry-run", false, "do not perform actions")
-	flag.BoolVar(&flags.NoDNS, "no-dns", false, "do not modify DNS")
-	flag.Parse()
+		logger.Printf("set annotations of cluster %s to: %v", name, annotations)
+		os.Exit(0)
+	}
 
 	// {{{2 Find auxiliary scripts
 	cwd, err := os.Getwd()
@@ -303,30 +4423,427 @@ func main() {
 			err.Error())
 	}
 
+	// {{{3 openshift-install-create-config.yaml.sh
+	createInstallConfigScript := filepath.Join(cwd,
+		"scripts/openshift-install-create-config.yaml.sh")
+	if _, err := os.Stat(createInstallConfigScript); err != nil {
+		logger.Fatalf("failed to stat scripts/openshift-install-create-config.yaml.sh: %s",
+			err.Error())
+	}
+
+	// {{{3 check-cluster-health.sh
+	checkClusterHealthScript := filepath.Join(cwd, "scripts/check-cluster-health.sh")
+	if _, err := os.Stat(checkClusterHealthScript); err != nil {
+		logger.Fatalf("failed to stat scripts/check-cluster-health.sh: %s",
+			err.Error())
+	}
+
+	// {{{2 Validate openshift-install configuration template
+	if flags.ValidateTemplate {
+		name, err := nextClusterName(cfg)
+		if err != nil {
+			logger.Fatalf("failed to get next cluster name: %s", err.Error())
+		}
+
+		installCfgStr, err := renderInstallConfig(createInstallConfigScript, cfg, name)
+		if err != nil {
+			logger.Fatalf("invalid openshift-install configuration template: %s",
+				err.Error())
+		}
+
+		installCfg, err := parseInstallConfig([]byte(installCfgStr))
+		if err != nil {
+			logger.Fatalf("invalid openshift-install configuration for cluster "+
+				"%s: %s\n%s", name, err.Error(), installCfgStr)
+		}
+
+		renderedName := ""
+		for _, item := range installCfg {
+			if item.Key != "metadata" {
+				continue
+			}
+
+			metadata, _ := item.Value.(yaml.MapSlice)
+			for _, metadataItem := range metadata {
+				if metadataItem.Key == "name" {
+					renderedName = fmt.Sprintf("%v", metadataItem.Value)
+				}
+			}
+		}
+		if renderedName != name {
+			logger.Fatalf("invalid openshift-install configuration for cluster "+
+				"%s: metadata.name is \"%s\"", name, renderedName)
+		}
+
+		fmt.Print(installCfgStr)
+		logger.Printf("openshift-install configuration for cluster %s is valid", name)
+		os.Exit(0)
+	}
+
+	// {{{2 Preflight
+	// Ensure programs the scripts need are installed
+	if !flags.SkipPreflight {
+		if missingProgs := missingPrograms(cfg); len(missingProgs) > 0 {
+			logger.Fatalf("required programs not found in PATH: %s, install these "+
+				"programs or run with -skip-preflight", strings.Join(missingProgs, ", "))
+		}
+	}
+
 	// {{{1 API setup
 	// {{{2 AWS
-	awsSess, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1"),
-	})
+	awsStartupBackoff := time.Duration(cfg.AWS.StartupBackoff * float64(time.Second))
+
+	var awsSess *session.Session
+	err = retryBackoff(logger, "create AWS session", cfg.AWS.StartupAttempts,
+		awsStartupBackoff, func() error {
+			awsCfg := &aws.Config{
+				Region:     aws.String(awsRegion),
+				MaxRetries: aws.Int(cfg.AWS.MaxRetries),
+			}
+
+			if len(cfg.AWS.Endpoint) > 0 {
+				awsCfg.Endpoint = aws.String(cfg.AWS.Endpoint)
+			}
+
+			var err error
+			awsSess, err = session.NewSession(awsCfg)
+			return err
+		})
 	if err != nil {
 		logger.Fatalf("failed to create AWS session: %s", err.Error())
 	}
 
+	if len(cfg.AWS.Endpoint) > 0 {
+		logger.Printf("using AWS API endpoint %s", cfg.AWS.Endpoint)
+	}
+
+	if cfg.AWS.MaxRetries == aws.UseServiceDefaultRetries {
+		logger.Print("AWS SDK retries failed API calls the default number of " +
+			"times for each service")
+	} else {
+		logger.Printf("AWS SDK retries failed API calls up to %d times",
+			cfg.AWS.MaxRetries)
+	}
+
+	// {{{3 Assume role
+	// assumedCreds are credentials for Config.AWS.AssumeRoleARN, nil if no
+	// role is assumed
+	var assumedCreds *credentials.Credentials = nil
+
+	if len(cfg.AWS.AssumeRoleARN) > 0 {
+		assumedCreds = stscreds.NewCredentials(awsSess, cfg.AWS.AssumeRoleARN,
+			func(p *stscreds.AssumeRoleProvider) {
+				// Credentials are passed to openshift-install, which can run
+				// for a long time
+				p.Duration = time.Hour
+				p.ExpiryWindow = time.Minute * 15
+
+				if len(cfg.AWS.ExternalID) > 0 {
+					p.ExternalID = aws.String(cfg.AWS.ExternalID)
+				}
+			})
+
+		err := retryBackoff(logger, "assume AWS role", cfg.AWS.StartupAttempts,
+			awsStartupBackoff, func() error {
+				_, err := assumedCreds.Get()
+				return err
+			})
+		if err != nil {
+			logger.Fatalf("failed to assume AWS role %s: %s",
+				cfg.AWS.AssumeRoleARN, err.Error())
+		}
+
+		awsSess = awsSess.Copy(&aws.Config{
+			Credentials: assumedCreds,
+		})
+
+		logger.Printf("assumed AWS role %s", cfg.AWS.AssumeRoleARN)
+	}
+
+	// {{{3 Check connectivity
+	// Credentials errors are not retried, since they will not go away
+	var callerIdentity *stsSvc.GetCallerIdentityOutput
+	var credsErr error = nil
+
+	// awsDate is the Date header of AWS's response, used to check the local
+	// clock
+	awsDate := ""
+	awsDateReceived := time.Time{}
+
+	err = retryBackoff(logger, "connect to AWS", cfg.AWS.StartupAttempts,
+		awsStartupBackoff, func() error {
+			req, out := stsSvc.New(awsSess).GetCallerIdentityRequest(
+				&stsSvc.GetCallerIdentityInput{})
+			err := req.Send()
+			if err != nil && isAWSCredentialsErr(err) {
+				credsErr = err
+				return nil
+			}
+
+			if req.HTTPResponse != nil {
+				awsDate = req.HTTPResponse.Header.Get("Date")
+				awsDateReceived = time.Now()
+			}
+
+			callerIdentity = out
+			return err
+		})
+	if credsErr != nil {
+		logger.Fatalf("AWS credentials are missing, invalid, or expired, set "+
+			"AWS_PROFILE or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and "+
+			"check AWS.AssumeRoleARN: %s", credsErr.Error())
+	}
+	if err != nil {
+		logger.Fatalf("failed to connect to AWS: %s", err.Error())
+	}
+
+	logger.Printf("using AWS account %s as %s",
+		aws.StringValue(callerIdentity.Account),
+		aws.StringValue(callerIdentity.Arn))
+
+	// {{{3 Check clock
+	// clockCorrection is subtracted from the local time when calculating cluster
+	// ages, so they are based on AWS's clock, which set instance launch times
+	clockCorrection := time.Duration(0)
+	maxClockSkew := time.Duration(cfg.AWS.MaxClockSkew * float64(time.Second))
+
+	if len(awsDate) == 0 {
+		logger.Print("WARNING: cannot check local clock, AWS response had no " +
+			"Date header")
+	} else if skew, err := clockSkew(awsDate, awsDateReceived); err != nil {
+		logger.Printf("WARNING: cannot check local clock: %s", err.Error())
+	} else if skew > maxClockSkew || skew < -maxClockSkew {
+		clockCorrection = skew
+
+		direction := "ahead of"
+		if skew < 0 {
+			direction = "behind"
+			skew = -skew
+		}
+		logger.Printf("WARNING: local clock is %s %s AWS's clock, more than "+
+			"AWS.MaxClockSkew, calculating cluster ages using AWS's clock, fix "+
+			"the local clock", skew.Round(time.Second).String(), direction)
+	}
+
+	// awsNow returns the current time according to AWS's clock
+	awsNow := func() time.Time {
+		return time.Now().Add(-clockCorrection)
+	}
+
+	// {{{3 EC2
 	ec2 := ec2Svc.New(awsSess)
 
+	if err := validateZones(ec2, cfg.OpenShiftInstall.Zones); err != nil {
+		logger.Fatalf("invalid OpenShiftInstall.Zones configuration: %s",
+			err.Error())
+	}
+
 	// {{{2 Cloudflare
 	cf, err := cloudflare.New(cfg.Cloudflare.APIKey, cfg.Cloudflare.Email)
 	if err != nil {
 		logger.Fatalf("failed to create a Cloudflare client: %s", err.Error())
 	}
 
+	// {{{1 Import cluster
+	if len(flags.Import) > 0 {
+		// {{{2 Check state directory
+		name, infraID, err := checkImportDir(cfg, flags.Import)
+		if err != nil {
+			logger.Fatalf("cannot import cluster from %s: %s", flags.Import,
+				err.Error())
+		}
+
+		// {{{2 Find cluster's instances
+		instanceIDs := []*string{}
+		err = ec2.DescribeInstancesPages(&ec2Svc.DescribeInstancesInput{
+			Filters: []*ec2Svc.Filter{
+				{
+					Name: aws.String(fmt.Sprintf("tag:%s%s", ClusterOwnedTagPrefix,
+						infraID)),
+					Values: aws.StringSlice([]string{"owned"}),
+				},
+				{
+					Name:   aws.String("instance-state-name"),
+					Values: aws.StringSlice([]string{"pending", "running"}),
+				},
+			},
+		}, func(page *ec2Svc.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					instanceIDs = append(instanceIDs, instance.InstanceId)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			logger.Fatalf("failed to describe instances of cluster %s: %s", name,
+				err.Error())
+		}
+
+		if len(instanceIDs) == 0 {
+			logger.Fatalf("cannot import cluster %s, no running instances with "+
+				"infrastructure ID %s found", name, infraID)
+		}
+
+		if flags.DryRun {
+			logger.Printf("would copy %s to %s and tag %d instances of cluster %s "+
+				"with %s=true", flags.Import, cfg.OpenShiftInstall.StateStorePath,
+				len(instanceIDs), name, ManagedTagKey)
+			os.Exit(0)
+		}
+
+		// {{{2 Copy state directory
+		dest := filepath.Join(cfg.OpenShiftInstall.StateStorePath, name)
+		if err := copyDir(flags.Import, dest); err != nil {
+			os.RemoveAll(dest)
+			logger.Fatalf("failed to copy %s to %s: %s", flags.Import, dest,
+				err.Error())
+		}
+
+		// {{{2 Tag instances as managed
+		importTags := []*ec2Svc.Tag{
+			{
+				Key:   aws.String(ManagedTagKey),
+				Value: aws.String("true"),
+			},
+		}
+		if envTagKey, envTagValue, _ := environmentTag(cfg); len(envTagKey) > 0 {
+			importTags = append(importTags, &ec2Svc.Tag{
+				Key:   aws.String(envTagKey),
+				Value: aws.String(envTagValue),
+			})
+		}
+
+		_, err = ec2.CreateTags(&ec2Svc.CreateTagsInput{
+			Resources: instanceIDs,
+			Tags:      importTags,
+		})
+		if err != nil {
+			os.RemoveAll(dest)
+			logger.Fatalf("failed to tag instances of cluster %s with %s=true: %s",
+				name, ManagedTagKey, err.Error())
+		}
+
+		logger.Printf("imported cluster %s with infrastructure ID %s, tagged %d "+
+			"instances and copied state directory to %s", name, infraID,
+			len(instanceIDs), dest)
+		os.Exit(0)
+	}
+
+	// {{{1 Status server
+	metrics := NewMetrics()
+	metrics.Describe("auto_cluster_last_success_timestamp_seconds", "gauge",
+		"Unix time the last successful control loop execution finished")
+	metrics.Describe("auto_cluster_aws_throttles_total", "counter",
+		"Number of AWS API requests which were throttled")
+
+	metrics.Describe("auto_cluster_cluster_age_seconds", "gauge",
+		"Age of each cluster found during the last control loop execution")
+	metrics.Describe("auto_cluster_actions_total", "counter",
+		"Number of planned actions by outcome: completed, failed, or skipped")
+	metrics.Describe("auto_cluster_quota_exceeded_total", "counter",
+		"Number of times creating a cluster failed because an AWS quota was exceeded")
+	metrics.Describe("auto_cluster_paused", "gauge",
+		"1 if plans are not being executed because the tool is paused, 0 otherwise")
+	metrics.Describe("auto_cluster_create_duration_seconds", "histogram",
+		"Time openshift-install took to successfully create a cluster")
+	metrics.Describe("auto_cluster_free_disk_bytes", "gauge",
+		"Free disk space of OpenShiftInstall.StateStorePath and WorkDir")
+	metrics.Describe("auto_cluster_skipped_loops_total", "counter",
+		"Number of control loop executions skipped due to Loop.ContinueOnError")
+	metrics.Describe("auto_cluster_create_failures", "gauge",
+		"Number of times in a row creating a cluster failed")
+	metrics.Describe("auto_cluster_create_breaker_open", "gauge",
+		"1 if cluster creation is paused due to repeated failures, 0 otherwise")
+
+	loopStatus := NewLoopStatus()
+
+	// createBreaker pauses cluster creation after repeated failures
+	createBreaker := &CreateBreaker{}
+	createBreaker.SetCooldown(time.Duration(cfg.Cluster.CreateCooldown *
+		float64(time.Hour)))
+
+	if len(cfg.Status.Addr) > 0 {
+		staleAge := time.Duration(cfg.Status.StaleAge * float64(time.Minute))
+
+		statusMux := http.NewServeMux()
+		statusMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		})
+		statusMux.HandleFunc("/readyz", readyzHandler(loopStatus, createBreaker,
+			staleAge))
+		statusMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			if _, err := metrics.WriteTo(w); err != nil {
+				logger.Printf("failed to write metrics: %s", err.Error())
+			}
+		})
+
+		if cfg.Status.Pprof {
+			statusMux.HandleFunc("/debug/pprof/", pprof.Index)
+			statusMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			statusMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			statusMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			statusMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+
+		go func() {
+			logger.Printf("starting status server on %s", cfg.Status.Addr)
+			if err := http.ListenAndServe(cfg.Status.Addr, statusMux); err != nil {
+				logger.Fatalf("failed to run status server: %s", err.Error())
+			}
+		}()
+	}
+
 	// {{{1 Control loop
 	if flags.Once {
 		logger.Print("running control loop once")
 	}
 
-	ctrlLoopTimer := time.NewTimer(0)
+	initialDelay := time.Duration(0)
+	if !flags.Once {
+		initialDelay = time.Duration(cfg.Loop.InitialDelay * float64(time.Second))
+	}
+
+	if initialDelay > 0 {
+		logger.Printf("waiting %s before first control loop execution, "+
+			"Loop.InitialDelay", initialDelay.String())
+	}
+
+	ctrlLoopTimer := time.NewTimer(initialDelay)
+
+	// unhealthyCounts is the number of consecutive control loop executions each
+	// cluster has failed its health probe, keys are cluster names
+	unhealthyCounts := map[string]uint{}
+
+	// prevClusters are the clusters found during the previous control loop
+	// execution, nil if there has not been one
+	var prevClusters map[string]Cluster = nil
+
+	// {{{2 Pause on SIGUSR1
+	// sigPaused indicates if the control loop was paused by SIGUSR1, when paused
+	// plans are made but not executed
+	sigPaused := false
+	sigPausedMutex := sync.Mutex{}
+
+	pauseSigs := make(chan os.Signal, 1)
+	signal.Notify(pauseSigs, syscall.SIGUSR1)
+
+	go func() {
+		for range pauseSigs {
+			sigPausedMutex.Lock()
+			sigPaused = !sigPaused
+			if sigPaused {
+				logger.Print("received SIGUSR1, paused, plans will not be executed " +
+					"until SIGUSR1 is received again")
+			} else {
+				logger.Print("received SIGUSR1, resumed")
+			}
+			sigPausedMutex.Unlock()
+		}
+	}()
 
+CTRL_LOOP_FOR:
 	for {
 		select {
 		case <-ctx.Done():
@@ -334,19 +4851,81 @@ func main() {
 			return
 			break
 		case <-ctrlLoopTimer.C:
+			// {{{2 Identify control loop execution
+			// All log messages during this execution are prefixed with loopID
+			loopStart := time.Now()
+			loopID := fmt.Sprintf("%08x", rand.Uint32())
+			logger := loggerChild(logger, fmt.Sprintf("loop-%s", loopID))
+
+			logEvent(logger, LogEvent{
+				Event:  "loop_start",
+				LoopID: loopID,
+			})
+
+			// stateFailed handles a failure to get state from an API. If
+			// Config.Loop.ContinueOnError is set the next control loop is
+			// scheduled and the caller must skip the rest of this execution,
+			// otherwise the program exits.
+			stateFailed := func(format string, v ...interface{}) {
+				msg := fmt.Sprintf(format, v...)
+				if !cfg.Loop.ContinueOnError || flags.Once {
+					logger.Fatal(msg)
+				}
+
+				metrics.Add("auto_cluster_skipped_loops_total", "", 1)
+				logger.Printf("WARNING: skipping control loop execution, sleeping "+
+					"15m before next iteration: %s", msg)
+				ctrlLoopTimer.Reset(time.Minute * 15)
+			}
+
+			// {{{2 Apply reloaded configuration
+			reloadedCfgMutex.Lock()
+			if reloadedCfg != nil {
+				newCF, err := cloudflare.New(reloadedCfg.Cloudflare.APIKey,
+					reloadedCfg.Cloudflare.Email)
+				if err != nil {
+					logger.Printf("failed to create a Cloudflare client with reloaded "+
+						"configuration, keeping current configuration: %s", err.Error())
+				} else if err := validateZones(ec2, reloadedCfg.OpenShiftInstall.Zones); err != nil {
+					logger.Printf("invalid OpenShiftInstall.Zones in reloaded "+
+						"configuration, keeping current configuration: %s", err.Error())
+				} else if err := checkConfig(*reloadedCfg); err != nil {
+					logger.Printf("invalid reloaded configuration, keeping current "+
+						"configuration: %s", err.Error())
+				} else if missingProgs := missingPrograms(*reloadedCfg); !flags.SkipPreflight &&
+					len(missingProgs) > 0 {
+
+					logger.Printf("programs required by reloaded configuration not "+
+						"found in PATH: %s, keeping current configuration",
+						strings.Join(missingProgs, ", "))
+				} else {
+					for _, field := range restartChanges(cfg, *reloadedCfg) {
+						logger.Printf("WARNING: reloaded configuration changes %s, "+
+							"which is only used at startup, restart to use the new "+
+							"value", field)
+					}
+
+					cfg = *reloadedCfg
+					cf = newCF
+					createBreaker.SetCooldown(time.Duration(
+						cfg.Cluster.CreateCooldown * float64(time.Hour)))
+					logger.Print("using reloaded configuration")
+				}
+
+				reloadedCfg = nil
+			}
+			reloadedCfgMutex.Unlock()
+
 			// {{{2 Get state
 			logger.Print("get state stage")
 
-			// clusters found, keys are cluster names
-			clusters := map[string]Cluster{}
-
 			// {{{3 Get DNS entries
 			rawRecords, err := cf.DNSRecords(cfg.Cloudflare.ZoneID, cloudflare.DNSRecord{
 				Type: "CNAME",
 			})
 			if err != nil {
-				logger.Fatalf("failed to get Cloudflare DNS records: %s",
-					err.Error())
+				stateFailed("failed to get Cloudflare DNS records: %s", err.Error())
+				continue CTRL_LOOP_FOR
 			}
 
 			records := []CFDNSRecord{}
@@ -387,200 +4966,298 @@ func main() {
 
 			// {{{3 Get EC2 instances who's names match Config.Cluster.NamePrefix
 			ec2NextToken := aws.String("")
+			ec2Throttles := uint(0)
+
+			// Instances are described once for each set of filters, since
+			// filters cannot be OR-ed together
+			ec2Filters := ec2InstanceFilters(cfg, flags)
+			ec2FiltersI := 0
+
+			// grouper groups instances into clusters as each page is described
+			grouper := NewInstanceGrouper(logger, cfg, flags, recordsCluster, awsNow)
 
-			clusterInstances := []EC2Instance{}
 			for {
 				ec2DescInput := &ec2Svc.DescribeInstancesInput{
+					Filters:   ec2Filters[ec2FiltersI],
 					NextToken: ec2NextToken,
 				}
 
-				resp, err := ec2.DescribeInstances(ec2DescInput)
+				var resp *ec2Svc.DescribeInstancesOutput
+				throttles, err := retryAWSThrottle(logger,
+					time.Duration(cfg.AWS.ThrottleMaxWait*float64(time.Second)),
+					func() error {
+						var err error
+						resp, err = ec2.DescribeInstances(ec2DescInput)
+						return err
+					})
+				ec2Throttles += throttles
 				if err != nil {
-					logger.Fatalf("failed to describe AWS EC2 instances: %s",
+					stateFailed("failed to describe AWS EC2 instances: %s",
 						err.Error())
+					continue CTRL_LOOP_FOR
 				}
 
 				for _, reservation := range resp.Reservations {
-					// For each instance
-				INSTANCES_FOR:
 					for _, instance := range reservation.Instances {
-						// Ensure is running
-						// See state code documentation: https://docs.aws.amazon.com/sdk-for-go/api/service/ec2/#InstanceState
-						// state code 16 is running, anything past running
-						// we want to ignore
-						if *instance.State.Code > int64(16) {
-							continue
-						}
-
-						// For each tag
-						for _, tag := range instance.Tags {
-							// If name tag
-							if *tag.Key == "Name" {
-								// If name matches cluster prefix
-								if strings.HasPrefix(*tag.Value, cfg.Cluster.NamePrefix) {
-									ec2Instance := EC2Instance{
-										Name:      *tag.Value,
-										CreatedOn: *instance.LaunchTime,
-									}
-									clusterInstances = append(clusterInstances, ec2Instance)
-
-									logger.Printf("found AWS EC2 instance: %s", ec2Instance.String())
-									continue INSTANCES_FOR
-								}
-							}
-						}
+						grouper.Add(instance)
 					}
 				}
 
 				// Paginate if we need to
 				ec2NextToken = resp.NextToken
 				if ec2NextToken == nil {
-					break
+					ec2FiltersI++
+					if ec2FiltersI >= len(ec2Filters) {
+						break
+					}
+
+					ec2NextToken = aws.String("")
 				}
 			}
 
-			// {{{3 Group matching EC2 instances into clusters
-			for _, instance := range clusterInstances {
-				// {{{4 Get cluster name from instance name
-				parts := strings.Split(instance.Name, "-")
+			metrics.Add("auto_cluster_aws_throttles_total", "", float64(ec2Throttles))
 
-				i := 0
-				clusterName := ""
+			if ec2Throttles > 0 {
+				logger.Printf("AWS API throttled %d describe EC2 instances request(s), "+
+					"consider running the control loop less often", ec2Throttles)
+			}
 
-				for !strings.HasPrefix(clusterName, cfg.Cluster.NamePrefix) && i < len(parts) {
-					clusterName = strings.Join(parts[:i], "-")
-					i += 1
-				}
+			// clusters found, keys are cluster names
+			clusters := grouper.Clusters
 
-				if !strings.HasPrefix(clusterName, cfg.Cluster.NamePrefix) {
-					logger.Fatalf("instance %s was selected as part of cluster but could not extract cluster name",
-						instance.Name)
-				}
+			// orphanInstances are instances of clusters created by this program
+			// which do not match Config.Cluster.NamePrefix, only found if
+			// Flags.ReapOrphans
+			orphanInstances := grouper.Orphans
 
-				// {{{4 Create cluster
-				if _, ok := clusters[clusterName]; ok {
-					continue
-				}
+			// {{{3 Probe cluster health
+			if cfg.Health.Probe {
+				for name, cluster := range clusters {
+					// Clusters not created by this tool have no kubeconfig
+					kubeconfig := filepath.Join(cfg.OpenShiftInstall.StateStorePath,
+						name, "auth", "kubeconfig")
+					if _, err := os.Stat(kubeconfig); err != nil {
+						logger.Printf("not probing health of cluster %s, no kubeconfig: %s",
+							name, err.Error())
+						continue
+					}
 
-				clusters[clusterName] = Cluster{
-					Name:       clusterName,
-					Age:        time.Since(instance.CreatedOn),
-					DNSPointed: clusterName == recordsCluster,
+					cmd := exec.Command(checkClusterHealthScript,
+						"-s", cfg.OpenShiftInstall.StateStorePath,
+						"-n", name)
+					err := runCmd(loggerChild(logger, "check-cluster-health.stdout"),
+						loggerChild(logger, "check-cluster-health.stderr"), cmd, 0,
+						time.Duration(cfg.Health.ProbeTimeout*float64(time.Minute)))
+					cluster.Healthy = err == nil
+					clusters[name] = cluster
+
+					if cluster.Healthy {
+						delete(unhealthyCounts, name)
+					} else {
+						unhealthyCounts[name]++
+						logger.Printf("cluster %s failed health probe %d time(s) in a row: %s",
+							name, unhealthyCounts[name], err.Error())
+					}
 				}
-			}
 
-			for _, cluster := range clusters {
-				logger.Printf("found cluster: %s", cluster.String())
+				// Forget clusters which no longer exist
+				for name := range unhealthyCounts {
+					if _, ok := clusters[name]; !ok {
+						delete(unhealthyCounts, name)
+					}
+				}
 			}
 
-			// {{{2 Determine what must be done given existing state
-			logger.Print("plan stage")
+			// {{{3 Check cluster consoles
+			if cfg.Health.ConsoleCheck {
+				for name, cluster := range clusters {
+					err := checkConsole(logger, cfg, name)
+					cluster.ConsoleReachable = err == nil
+					clusters[name] = cluster
 
-			// {{{3 OpenShift install plan
-			osInstallPlan := OSInstallPlan{
-				Delete: []Cluster{},
-				Create: []Cluster{},
+					if err != nil {
+						logger.Printf("cluster %s failed console check, cannot become "+
+							"primary: %s", name, err.Error())
+					}
+				}
 			}
 
-			// youngClusters is a list of clusters which are less than
-			// Config.Cluster.OldestAge hours old
-			youngClusters := []Cluster{}
-
-			// primaryCluster is the cluster, existing or to be created, which
-			// will be used to host the site. This means developers will access this
-			// cluster via oc and end users will access this cluster via a domain.
-			var primaryCluster *Cluster = nil
-
-			// {{{4 Group clusters as old (older than cfg.Cluster.OldestAge) or young
 			for _, cluster := range clusters {
-				// Plan to delete old clusters
-				if cluster.Age.Hours() > cfg.Cluster.OldestAge {
-					osInstallPlan.Delete = append(osInstallPlan.Delete,
-						cluster)
-				} else {
-					youngClusters = append(youngClusters, cluster)
-				}
+				logger.Printf("found cluster: %s", cluster.String())
 			}
 
-			// {{{4 Figure out what to do with young clusters
-			if len(youngClusters) == 0 { // If no young clusters we have to create a new one
-				// {{{5 Get next cluster number
-				maxClusterNum := int64(0)
+			// {{{3 Group orphaned EC2 instances into clusters
+			// orphans are clusters created by this program which do not match
+			// Config.Cluster.NamePrefix, keys are cluster names
+			orphans := map[string]Cluster{}
 
-				// {{{6 Find highest numeric value in openshift install data store path
-				dirs, err := ioutil.ReadDir(cfg.OpenShiftInstall.StateStorePath)
+			if len(orphanInstances) > 0 {
+				// Orphaned cluster names do not have a known prefix, so find the
+				// state store directory which instance names start with
+				stateDirs, err := ioutil.ReadDir(cfg.OpenShiftInstall.StateStorePath)
 				if err != nil {
-					logger.Fatalf("failed to read existing cluster credentials directory")
+					stateFailed("failed to read state store directory: %s", err.Error())
+					continue CTRL_LOOP_FOR
 				}
 
-				for _, dir := range dirs {
-					if !dir.IsDir() {
+				for _, instance := range orphanInstances {
+					clusterName := ""
+					for _, dir := range stateDirs {
+						if dir.IsDir() && strings.HasPrefix(instance.Name, dir.Name()+"-") &&
+							len(dir.Name()) > len(clusterName) {
+							clusterName = dir.Name()
+						}
+					}
+
+					if len(clusterName) == 0 {
+						logger.Printf("cannot reap orphaned instance %s, no state store "+
+							"directory for its cluster", instance.Name)
 						continue
 					}
 
-					if !strings.HasPrefix(dir.Name(), cfg.Cluster.NamePrefix) {
+					if err := validClusterName(clusterName); err != nil {
+						logger.Printf("cannot reap orphaned instance %s, its cluster "+
+							"name \"%s\" is invalid: %s", instance.Name, clusterName,
+							err.Error())
 						continue
 					}
 
-					numStr := strings.ReplaceAll(dir.Name(),
-						cfg.Cluster.NamePrefix, "")
-					num, err := strconv.ParseInt(numStr, 10, 64)
-					if err != nil {
-						logger.Fatalf("failed to parse cluster number for "+
-							"previous cluster credentials directory %s: %s",
-							dir.Name(), err.Error())
+					if cluster, ok := orphans[clusterName]; ok {
+						if !instance.Running {
+							cluster.Running = false
+							orphans[clusterName] = cluster
+						}
+						continue
 					}
 
-					if num > maxClusterNum {
-						maxClusterNum = num
+					orphans[clusterName] = Cluster{
+						Name:             clusterName,
+						Age:              awsNow().Sub(instance.CreatedOn),
+						Healthy:          true,
+						Running:          instance.Running,
+						ConsoleReachable: true,
 					}
 				}
+			}
 
-				// {{{6 Add 1 to highest found numeric prefix
-				nextClusterNum := maxClusterNum + 1
-				nextClusterNumStr := fmt.Sprintf("%d", nextClusterNum)
-				if nextClusterNum < 10 {
-					nextClusterNumStr = fmt.Sprintf("0%s",
-						nextClusterNumStr)
-				}
+			for _, cluster := range orphans {
+				logger.Printf("found orphaned cluster: %s", cluster.String())
+			}
+
+			// {{{3 Find state directories of clusters without instances
+			// instancelessClusters are clusters with a state directory which
+			// openshift-install has not destroyed but which have no instances,
+			// keys are cluster names
+			instancelessClusters, err := findInstancelessClusters(logger, cfg,
+				clusters, orphans, time.Now(), func(infraID string) ([]string, error) {
+					states := []string{}
+					input := &ec2Svc.DescribeInstancesInput{
+						Filters: infraInstanceFilters(infraID),
+					}
+
+					for {
+						var resp *ec2Svc.DescribeInstancesOutput
+						_, err := retryAWSThrottle(logger,
+							time.Duration(cfg.AWS.ThrottleMaxWait*float64(time.Second)),
+							func() error {
+								var err error
+								resp, err = ec2.DescribeInstances(input)
+								return err
+							})
+						if err != nil {
+							return nil, err
+						}
+
+						for _, reservation := range resp.Reservations {
+							for _, instance := range reservation.Instances {
+								state := ""
+								if instance.State != nil {
+									state = aws.StringValue(instance.State.Name)
+								}
+								states = append(states, state)
+							}
+						}
+
+						if resp.NextToken == nil {
+							return states, nil
+						}
+						input.NextToken = resp.NextToken
+					}
+				})
+			if err != nil {
+				stateFailed("failed to find clusters without instances: %s",
+					err.Error())
+				continue CTRL_LOOP_FOR
+			}
 
-				// {{{5 Plan to create new cluster
-				c := Cluster{
-					Name: fmt.Sprintf("%s%s", cfg.Cluster.NamePrefix,
-						nextClusterNumStr),
-				}
+			// {{{3 Record cluster age metrics
+			// Reset so deleted clusters are not reported
+			metrics.Reset("auto_cluster_cluster_age_seconds")
+			for name, cluster := range clusters {
+				metrics.Set("auto_cluster_cluster_age_seconds",
+					fmt.Sprintf("cluster=\"%s\"", name), cluster.Age.Seconds())
+			}
 
-				osInstallPlan.Create = []Cluster{c}
-				primaryCluster = &c
+			// {{{3 Check free disk space
+			// freeSpaceErr is not nil if there is not enough free disk space to
+			// create a cluster
+			diskFree, freeSpaceErr := checkFreeSpace(cfg)
+			for path, pathFree := range diskFree {
+				metrics.Set("auto_cluster_free_disk_bytes",
+					fmt.Sprintf("path=\"%s\"", path), float64(pathFree))
+			}
 
-			} else if len(youngClusters) > 1 { // More than 1 young clusters exist, delete all but the youngest
-				// {{{5 Find youngest cluster
-				youngestAge := float64(48)
-				youngestName := ""
+			// {{{3 Compare with previous control loop execution
+			if prevClusters != nil {
+				for name, cluster := range clusters {
+					prev, ok := prevClusters[name]
+					if !ok {
+						logger.Printf("since last control loop: cluster %s appeared", name)
+						continue
+					}
 
-				for _, cluster := range youngClusters {
+					if !prev.Expired(cfg.Cluster.OldestAge, awsNow()) &&
+						cluster.Expired(cfg.Cluster.OldestAge, awsNow()) {
+						logger.Printf("since last control loop: cluster %s expired", name)
+					}
 
-					if cluster.Age.Hours() < youngestAge {
-						youngestAge = cluster.Age.Hours()
-						youngestName = cluster.Name
+					if prev.Healthy != cluster.Healthy {
+						logger.Printf("since last control loop: cluster %s health "+
+							"changed from Healthy=%t to Healthy=%t", name,
+							prev.Healthy, cluster.Healthy)
 					}
 				}
 
-				// {{{5 Plan to delete all but youngest cluster
-				for _, cluster := range youngClusters {
-					if cluster.Name != youngestName {
-						osInstallPlan.Delete = append(osInstallPlan.Delete,
-							cluster)
-					} else {
-						primaryCluster = &cluster
+				for name := range prevClusters {
+					if _, ok := clusters[name]; !ok {
+						logger.Printf("since last control loop: cluster %s disappeared", name)
 					}
 				}
-			} else if len(youngClusters) == 1 { // If exactly 1 young cluster, keep
-				primaryCluster = &youngClusters[0]
 			}
 
-			if primaryCluster == nil {
-				logger.Fatal("failed to resolve primary cluster")
+			prevClusters = clusters
+
+			// {{{2 Determine what must be done given existing state
+			logger.Print("plan stage")
+
+			// {{{3 OpenShift install plan
+			osInstallPlan, primaryCluster, primaryReasons, err := planClusters(
+				clusters, orphans, cfg, awsNow(), PlanState{
+					Logger:          logger,
+					Instanceless:    instancelessClusters,
+					UnhealthyCounts: unhealthyCounts,
+					RecordsCluster:  recordsCluster,
+					RotatePrimary:   flags.RotatePrimary,
+					NextName: func() (string, error) {
+						return nextClusterName(cfg)
+					},
+					CreatePaused:   createBreaker.Open(),
+					CreateFailures: createBreaker.Failures(),
+					FreeSpaceErr:   freeSpaceErr,
+				})
+			if err != nil {
+				stateFailed("cannot create cluster: %s", err.Error())
+				continue CTRL_LOOP_FOR
 			}
 
 			// {{{3 Cloudflare DNS plan
@@ -588,7 +5265,9 @@ func main() {
 				Set: []CFDNSRecord{},
 			}
 
-			if !primaryCluster.DNSPointed {
+			if flags.NoDNS {
+				logger.Print("not planning Cloudflare DNS changes, -no-dns passed")
+			} else if primaryCluster != nil && !primaryCluster.DNSPointed {
 				// Point all records to primary cluster
 				for _, record := range records {
 					if record.ClusterName == primaryCluster.Name {
@@ -606,7 +5285,8 @@ func main() {
 
 			// If DNS pointed to a different cluster probably means primary cluster used to be
 			// a different.
-			if primaryCluster.Name != recordsCluster && len(cfg.Helm.Chart) > 0 {
+			if primaryCluster != nil && primaryCluster.Name != recordsCluster &&
+				len(cfg.Helm.Chart) > 0 {
 				// If cluster DNS is pointing to exists, then migrate from
 				if _, ok := clusters[recordsCluster]; ok {
 					helmPlan = &HelmInstallPlan{
@@ -629,74 +5309,626 @@ func main() {
 			} else {
 				logger.Printf("helm plan: %s", *helmPlan)
 			}
-			logger.Printf("primary cluster=%s", *primaryCluster)
+
+			if primaryCluster == nil {
+				logger.Print("primary cluster: none")
+			} else {
+				logger.Printf("primary cluster=%s", *primaryCluster)
+			}
+
+			// {{{3 Output clusters and plan
+			if flags.Output == "yaml" {
+				docs := []YAMLDocument{}
+
+				clusterNames := []string{}
+				for name := range clusters {
+					clusterNames = append(clusterNames, name)
+				}
+				sort.Strings(clusterNames)
+
+				for _, name := range clusterNames {
+					status, err := clusters[name].MarshalYAML()
+					if err != nil {
+						logger.Fatalf("failed to output cluster %s: %s", name,
+							err.Error())
+					}
+
+					// Add credentials if the cluster has a state directory
+					creds, err := readClusterCredentials(cfg, name)
+					if err == nil {
+						if !flags.ShowCredentials {
+							creds.KubeadminPassword = "REDACTED"
+						}
+
+						status = append(status.(yaml.MapSlice),
+							yaml.MapItem{Key: "consoleURL", Value: creds.ConsoleURL},
+							yaml.MapItem{Key: "kubeadminPassword",
+								Value: creds.KubeadminPassword})
+					}
+
+					annotations, err := readAnnotations(cfg, name)
+					if err != nil {
+						logger.Printf("failed to read annotations of cluster %s: %s",
+							name, err.Error())
+					} else if len(annotations) > 0 {
+						status = append(status.(yaml.MapSlice),
+							yaml.MapItem{Key: "annotations", Value: annotations})
+					}
+
+					docs = append(docs, YAMLDocument{
+						Kind:     "Cluster",
+						Metadata: YAMLMetadata{Name: name},
+						Status:   status,
+					})
+				}
+
+				primaryName := ""
+				if primaryCluster != nil {
+					primaryName = primaryCluster.Name
+				}
+
+				docs = append(docs, YAMLDocument{
+					Kind:     "Plan",
+					Metadata: YAMLMetadata{Name: loopID},
+					Spec: yaml.MapSlice{
+						{Key: "primaryCluster", Value: primaryName},
+						{Key: "openShiftInstall", Value: osInstallPlan},
+						{Key: "cloudflareDNS", Value: cfDNSPlan},
+						{Key: "helm", Value: helmPlan},
+					},
+				})
+
+				if err := writeYAMLDocuments(os.Stdout, docs); err != nil {
+					logger.Fatalf("failed to output clusters and plan: %s", err.Error())
+				}
+			}
+
+			// {{{3 Explain primary cluster
+			if flags.ExplainPrimary {
+				explainNames := []string{}
+				for name := range primaryReasons {
+					explainNames = append(explainNames, name)
+				}
+				sort.Strings(explainNames)
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "CLUSTER\tAGE\tHEALTHY\tWITHIN OLDEST AGE\tREASON")
+				for _, name := range explainNames {
+					cluster, ok := clusters[name]
+					if !ok {
+						fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", name, primaryReasons[name])
+						continue
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\n", name,
+						cluster.Age.Round(time.Minute).String(), cluster.Healthy,
+						!cluster.Expired(cfg.Cluster.OldestAge, awsNow()),
+						primaryReasons[name])
+				}
+				if err := w.Flush(); err != nil {
+					logger.Fatalf("failed to print primary cluster explanation: %s",
+						err.Error())
+				}
+
+				os.Exit(0)
+			}
+
+			// {{{3 Detect drift
+			if flags.DetectDrift {
+				if len(osInstallPlan.Create) > 0 || len(osInstallPlan.Delete) > 0 {
+					logger.Printf("drift detected, would change clusters: %s",
+						osInstallPlan.String())
+					os.Exit(1)
+				}
+
+				logger.Print("no drift detected, no clusters would be created or deleted")
+				os.Exit(0)
+			}
+
+			// {{{3 Skip execution if paused
+			sigPausedMutex.Lock()
+			paused := sigPaused
+			sigPausedMutex.Unlock()
+
+			pauseFile := filepath.Join(cfg.OpenShiftInstall.StateStorePath, "PAUSE")
+			if _, err := os.Stat(pauseFile); err == nil {
+				logger.Printf("paused, %s file exists, remove to resume", pauseFile)
+				paused = true
+			} else if paused {
+				logger.Print("paused by SIGUSR1, send SIGUSR1 to resume")
+			}
+
+			if paused {
+				logger.Print("not executing plan since paused")
+				osInstallPlan = OSInstallPlan{
+					Create: []Cluster{},
+					Delete: []Cluster{},
+				}
+				helmPlan = nil
+				cfDNSPlan.Set = []CFDNSRecord{}
+			}
+
+			pausedMetric := 0.0
+			if paused {
+				pausedMetric = 1
+			}
+			metrics.Set("auto_cluster_paused", "", pausedMetric)
+
+			// {{{3 Write metrics snapshot
+			if flags.MetricsSnapshot {
+				if _, err := metrics.WriteOpenMetricsTo(os.Stdout); err != nil {
+					logger.Fatalf("failed to write metrics snapshot: %s", err.Error())
+				}
+
+				os.Exit(0)
+			}
 
 			// {{{3 Execute plans
 			logger.Print("execute stage")
+
+			// execResult records the outcome of each planned action
+			execResult := ExecutionResult{}
+
+			// actionErrs are the failures of actions in this execution
+			actionErrs := []string{}
+
+			// actionFailed handles a failure to execute an action. If
+			// Config.Loop.ContinueOnError is set the failure is recorded and the
+			// caller must skip the action, and the rest of the plan which depends
+			// on it, otherwise the program exits.
+			actionFailed := func(format string, v ...interface{}) {
+				msg := fmt.Sprintf(format, v...)
+				if !cfg.Loop.ContinueOnError || flags.Once {
+					logger.Fatal(msg)
+				}
+
+				logger.Printf("WARNING: %s", msg)
+				actionErrs = append(actionErrs, msg)
+			}
+
+			// audit appends a record of a cluster being created or deleted to
+			// Config.Audit.LogPath
+			audit := func(action string, cluster Cluster, outcome string) {
+				if len(cfg.Audit.LogPath) == 0 {
+					return
+				}
+
+				err := appendAuditRecord(cfg.Audit.LogPath, AuditRecord{
+					Time:    time.Now(),
+					Version: version,
+					LoopID:  loopID,
+					Action:  action,
+					Cluster: cluster.Name,
+					InfraID: cluster.InfraID,
+					Outcome: outcome,
+				})
+				if err != nil {
+					actionFailed("failed to write audit record for %s of cluster %s: %s",
+						action, cluster.Name, err.Error())
+				}
+			}
+			for _, cluster := range osInstallPlan.Create {
+				execResult.Planned("create", cluster.Name)
+			}
+			if helmPlan != nil {
+				execResult.Planned("helm_install", helmPlan.Cluster.Name)
+			}
+			for _, record := range cfDNSPlan.Set {
+				execResult.Planned("dns_set", record.Record.Name)
+			}
+			for _, cluster := range osInstallPlan.Delete {
+				execResult.Planned("delete", cluster.Name)
+			}
+
 			// {{{4 OpenShift install create
 			logger.Printf("execute OpenShift install create")
 
-			for _, cluster := range osInstallPlan.Create {
+			// createFailed indicates a cluster could not be created, the rest of the
+			// plan depends on the new cluster so it is not executed
+			createFailed := false
+
+			// lastInstallEnd is when the last openshift-install create or delete
+			// finished, zero if there has not been one
+			lastInstallEnd := time.Time{}
+
+			// deadlineExceeded indicates Config.Loop.Deadline was exceeded
+			deadlineExceeded := false
+
+			// pastDeadline returns true if Config.Loop.Deadline was exceeded, the
+			// first time it is the rest of the plan is deferred
+			pastDeadline := func() bool {
+				if deadlineExceeded {
+					return true
+				}
+
+				deadline := time.Duration(cfg.Loop.Deadline * float64(time.Minute))
+				if deadline == 0 || time.Since(loopStart) < deadline {
+					return false
+				}
+
+				logger.Printf("WARNING: control loop execution exceeded Loop.Deadline "+
+					"of %s, deferring rest of plan to next control loop execution",
+					deadline.String())
+				deadlineExceeded = true
+				osInstallPlan.Create = []Cluster{}
+				helmPlan = nil
+				cfDNSPlan.Set = []CFDNSRecord{}
+				osInstallPlan.Delete = []Cluster{}
+
+				return true
+			}
+
+			// abandonCreate records that creating cluster failed, the rest of the
+			// plan depends on the new cluster so it is not executed
+			abandonCreate := func(cluster Cluster, reason string) {
+				execResult.Record("create", cluster.Name, "failed")
+				audit("create", cluster, "failed")
+				logger.Printf("not executing rest of plan since %s", reason)
+				createFailed = true
+				helmPlan = nil
+				cfDNSPlan.Set = []CFDNSRecord{}
+				osInstallPlan.Delete = []Cluster{}
+			}
+
+			// nameRetries is the number of times creating a cluster was retried with a
+			// new name
+			nameRetries := uint(0)
+
+			// Clusters are appended to osInstallPlan.Create when retrying with a new
+			// name, so it is iterated by index
+			for i := 0; i < len(osInstallPlan.Create); i++ {
+				cluster := osInstallPlan.Create[i]
+
+				if pastDeadline() {
+					break
+				}
+
 				// {{{5 Dry run
 				if flags.DryRun {
-					logger.Printf("would exec %s -s %s -a create -n %s",
+					logger.Printf("would exec %s -s %s -a create -n %s -l %s",
 						runOpenShiftInstallScript,
 						cfg.OpenShiftInstall.StateStorePath,
-						cluster.Name)
+						cluster.Name, cfg.OpenShiftInstall.LogLevel)
+
+					installCfg, err := renderInstallConfig(createInstallConfigScript,
+						cfg, cluster.Name)
+					if err != nil {
+						logger.Printf("failed to render openshift-install configuration "+
+							"for cluster %s: %s", cluster.Name, err.Error())
+					} else {
+						logger.Printf("would create cluster %s with openshift-install "+
+							"configuration:\n%s", cluster.Name, installCfg)
+					}
+
+					if len(cfg.Hooks.PostCreate) > 0 {
+						logger.Printf("would run post create hook: %s",
+							cfg.Hooks.PostCreate)
+					}
+
 					logger.Print("would message Slack with new credentials")
 					continue
 				}
 
 				// {{{5 Create cluster
-				cmd := exec.Command(runOpenShiftInstallScript,
+				createStart := time.Now()
+				createArgs := []string{
 					"-s", cfg.OpenShiftInstall.StateStorePath,
 					"-a", "create",
-					"-n", cluster.Name)
-				err := runCmd(loggerChild(logger, "openshift-install.create.stdout"),
-					loggerChild(logger, "openshift-install.create.stderr"), cmd)
+					"-n", cluster.Name,
+					"-l", cfg.OpenShiftInstall.LogLevel,
+				}
+
+				baseInstallCfgPath := ""
+				if len(cfg.OpenShiftInstall.BaseInstallConfigPath) > 0 {
+					baseInstallCfgPath, err = writeBaseInstallConfig(cfg, cluster.Name)
+					if err != nil {
+						actionFailed("failed to write openshift-install configuration "+
+							"for cluster %s from OpenShiftInstall.BaseInstallConfigPath: %s",
+							cluster.Name, err.Error())
+						abandonCreate(cluster, "cluster creation failed")
+						break
+					}
+					createArgs = append(createArgs, "-c", baseInstallCfgPath)
+				}
+
+				if len(cfg.OpenShiftInstall.WorkDir) > 0 {
+					createArgs = append(createArgs, "-w", cfg.OpenShiftInstall.WorkDir)
+				}
+
+				cmd := exec.Command(runOpenShiftInstallScript, createArgs...)
+				if keys := installEnvKeys(cfg); len(keys) > 0 {
+					logger.Printf("setting openshift-install environment variables: %s",
+						strings.Join(keys, ", "))
+				}
+				cmd.Env, err = awsCredsEnv(installConfigEnv(cfg), assumedCreds)
+				if err != nil {
+					actionFailed("failed to get environment for creating cluster %s: %s",
+						cluster.Name, err.Error())
+					if len(baseInstallCfgPath) > 0 {
+						if err := os.Remove(baseInstallCfgPath); err != nil {
+							logger.Printf("failed to remove temporary openshift-install "+
+								"configuration file %s: %s", baseInstallCfgPath, err.Error())
+						}
+					}
+					abandonCreate(cluster, "cluster creation failed")
+					break
+				}
+				createLog, closeCreateLog := openClusterLog(logger, cfg, cluster.Name,
+					"create.log", true)
+				quotaMatch := NewMatchWriter(quotaExceededExp)
+				nameCollisionMatch := NewMatchWriter(nameCollisionExp)
+				createOut := io.MultiWriter(createLog, quotaMatch, nameCollisionMatch)
+				err := runCmd(
+					loggerTee(loggerChild(logger, "openshift-install.create.stdout"),
+						createOut),
+					loggerTee(loggerChild(logger, "openshift-install.create.stderr"),
+						createOut),
+					cmd, installIdleTimeout(cfg), 0)
+				closeCreateLog()
+				lastInstallEnd = time.Now()
+				if len(baseInstallCfgPath) > 0 {
+					if err := os.Remove(baseInstallCfgPath); err != nil {
+						logger.Printf("failed to remove temporary openshift-install "+
+							"configuration file %s: %s", baseInstallCfgPath, err.Error())
+					}
+				}
 				if err != nil {
-					logger.Fatalf("failed to create cluster %s: %s",
+					logEvent(logger, LogEvent{
+						Event:   "error",
+						LoopID:  loopID,
+						Cluster: cluster.Name,
+						Action:  "create",
+						Error:   err.Error(),
+					})
+					logger.Printf("failed to create cluster %s: %s",
 						cluster.Name, err.Error())
+
+					// {{{6 Gather bootstrap logs
+					// Before anything could delete the failed cluster's resources
+					if cfg.OpenShiftInstall.GatherOnFailure {
+						gatherArgs := []string{
+							"-s", cfg.OpenShiftInstall.StateStorePath,
+							"-a", "gather",
+							"-n", cluster.Name,
+							"-l", cfg.OpenShiftInstall.LogLevel,
+						}
+						if len(cfg.OpenShiftInstall.WorkDir) > 0 {
+							gatherArgs = append(gatherArgs, "-w",
+								cfg.OpenShiftInstall.WorkDir)
+						}
+						cmd := exec.Command(runOpenShiftInstallScript, gatherArgs...)
+						gatherEnv, envErr := awsCredsEnv(installEnv(cfg), assumedCreds)
+						if envErr != nil {
+							actionFailed("failed to get environment for gathering logs "+
+								"of cluster %s: %s", cluster.Name, envErr.Error())
+						} else {
+							cmd.Env = gatherEnv
+							gatherLog, closeGatherLog := openClusterLog(logger, cfg,
+								cluster.Name, "gather.log", false)
+							err := runCmd(
+								loggerTee(loggerChild(logger,
+									"openshift-install.gather.stdout"), gatherLog),
+								loggerTee(loggerChild(logger,
+									"openshift-install.gather.stderr"), gatherLog),
+								cmd, installIdleTimeout(cfg), 0)
+							closeGatherLog()
+							if err != nil {
+								logger.Printf("WARNING: failed to gather bootstrap logs "+
+									"of cluster %s: %s", cluster.Name, err.Error())
+							} else {
+								logger.Printf("gathered bootstrap logs of cluster %s "+
+									"into its state directory", cluster.Name)
+							}
+						}
+					}
+
+					// {{{6 Remove work directory
+					// Files needed to delete the cluster were copied to its state
+					// directory
+					if len(cfg.OpenShiftInstall.WorkDir) > 0 {
+						workDir := filepath.Join(cfg.OpenShiftInstall.WorkDir,
+							cluster.Name)
+						if err := os.RemoveAll(workDir); err != nil {
+							logger.Printf("failed to remove work directory %s of "+
+								"cluster %s: %s", workDir, cluster.Name, err.Error())
+						}
+					}
+
+					// {{{6 Retry with a new name if the name collided
+					collisionLine := nameCollisionMatch.Matched()
+					if len(collisionLine) > 0 && len(quotaMatch.Matched()) == 0 &&
+						nameRetries < cfg.Cluster.CreateNameRetries {
+
+						// The failed cluster's state directory is intentionally kept.
+						// Its metadata.json is needed to destroy the AWS resources
+						// openshift-install created before failing, which a later
+						// control loop execution does, see instancelessClusters.
+						// Removing it would leak those resources, and would let
+						// nextClusterName pick the failed name again.
+						newName, err := nextClusterName(cfg)
+						if err != nil {
+							actionFailed("cannot retry creating cluster %s with a new "+
+								"name: %s", cluster.Name, err.Error())
+							cluster.InfraID = stateInfraID(cfg, cluster.Name)
+							abandonCreate(cluster, "cluster creation failed")
+							break
+						}
+
+						nameRetries++
+						logger.Printf("WARNING: creating cluster %s failed because AWS "+
+							"resources with its name already exist, retrying with name "+
+							"%s (retry %d of %d): %s", cluster.Name, newName, nameRetries,
+							cfg.Cluster.CreateNameRetries, collisionLine)
+
+						execResult.Record("create", cluster.Name, "failed")
+						cluster.InfraID = stateInfraID(cfg, cluster.Name)
+						audit("create", cluster, "failed")
+
+						// Point the rest of the plan at the new cluster
+						for j := range cfDNSPlan.Set {
+							cfDNSPlan.Set[j].Record.Content = strings.ReplaceAll(
+								cfDNSPlan.Set[j].Record.Content, cluster.Name, newName)
+						}
+						if helmPlan != nil && helmPlan.Cluster.Name == cluster.Name {
+							helmPlan.Cluster.Name = newName
+						}
+						for j, outcome := range execResult.Outcomes {
+							if outcome.Action == "helm_install" &&
+								outcome.Target == cluster.Name {
+								execResult.Outcomes[j].Target = newName
+							}
+						}
+
+						execResult.Planned("create", newName)
+						osInstallPlan.Create = append(osInstallPlan.Create,
+							Cluster{Name: newName})
+						continue
+					}
+
+					if quotaLine := quotaMatch.Matched(); len(quotaLine) > 0 {
+						// Retrying will fail until the quota is raised or
+						// resources are freed
+						createBreaker.Trip()
+						metrics.Add("auto_cluster_quota_exceeded_total", "", 1)
+						logger.Printf("WARNING: creating cluster %s failed because an "+
+							"AWS quota was exceeded, pausing cluster creation for %.1f "+
+							"hours: %s", cluster.Name, cfg.Cluster.CreateCooldown,
+							quotaLine)
+
+						if cfg.Slack.NotifyQuotaExceeded {
+							err := postSlack(cfg.Slack.IncomingWebhook, fmt.Sprintf(
+								"*Failed to create cluster %s, AWS quota exceeded*\n"+
+									"Cluster creation is paused for %.1f hours\n`%s`",
+								cluster.Name, cfg.Cluster.CreateCooldown, quotaLine))
+							if err != nil {
+								logger.Printf("failed to notify Slack that AWS quota "+
+									"was exceeded: %s", err.Error())
+							}
+						}
+					} else if createBreaker.Failed(cfg.Cluster.CreateFailureLimit) {
+						logger.Printf("WARNING: creating a cluster failed %d times in a "+
+							"row, pausing cluster creation for %.1f hours",
+							createBreaker.Failures(), cfg.Cluster.CreateCooldown)
+					}
+
+					cluster.InfraID = stateInfraID(cfg, cluster.Name)
+					abandonCreate(cluster, "cluster creation failed")
+					break
+				}
+
+				createDuration := time.Since(createStart)
+				metrics.Observe("auto_cluster_create_duration_seconds", "",
+					createDurationBuckets, createDuration.Seconds())
+				logger.Printf("created cluster %s, took %s", cluster.Name,
+					createDuration.Round(time.Second).String())
+				logEvent(logger, LogEvent{
+					Event:    "create",
+					LoopID:   loopID,
+					Cluster:  cluster.Name,
+					Action:   "create",
+					Duration: createDuration.Seconds(),
+				})
+
+				cluster.InfraID = stateInfraID(cfg, cluster.Name)
+
+				// {{{5 Run post create hook
+				if len(cfg.Hooks.PostCreate) > 0 {
+					err := runHook(logger, cfg, "post-create-hook", cfg.Hooks.PostCreate,
+						cluster)
+					if err != nil && cfg.Hooks.PostCreateFailure == "delete" {
+						logEvent(logger, LogEvent{
+							Event:   "error",
+							LoopID:  loopID,
+							Cluster: cluster.Name,
+							Action:  "post_create_hook",
+							Error:   err.Error(),
+						})
+						logger.Printf("post create hook failed for cluster %s, will "+
+							"delete cluster: %s", cluster.Name, err.Error())
+
+						createBreaker.Failed(cfg.Cluster.CreateFailureLimit)
+						execResult.Record("create", cluster.Name, "failed")
+						audit("create", cluster, "failed")
+						execResult.Planned("delete", cluster.Name)
+
+						logger.Print("not executing rest of plan since post create " +
+							"hook failed")
+						createFailed = true
+						helmPlan = nil
+						cfDNSPlan.Set = []CFDNSRecord{}
+						osInstallPlan.Delete = []Cluster{cluster}
+						break
+					} else if err != nil {
+						logEvent(logger, LogEvent{
+							Event:   "error",
+							LoopID:  loopID,
+							Cluster: cluster.Name,
+							Action:  "post_create_hook",
+							Error:   err.Error(),
+						})
+						logger.Printf("WARNING: post create hook failed for cluster "+
+							"%s: %s", cluster.Name, err.Error())
+					} else {
+						logger.Printf("ran post create hook for cluster %s",
+							cluster.Name)
+					}
 				}
 
-				logger.Printf("created cluster %s", cluster.Name)
+				createBreaker.Succeeded()
+				execResult.Record("create", cluster.Name, "completed")
+				audit("create", cluster, "completed")
 
 				// {{{5 Post new credentials to Slack
 				// {{{6 Get kubeadmin user dashboard password
-				kubeadminPw, err := ioutil.ReadFile(filepath.Join(
-					cfg.OpenShiftInstall.StateStorePath,
-					cluster.Name, "auth", "kubeadmin-password"))
+				creds, err := readClusterCredentials(cfg, cluster.Name)
 				if err != nil {
-					logger.Fatalf("failed to open kubeadmin-password file for "+
-						"cluster %s: %s", err.Error())
-				}
-
-				// {{{6 Encode Slack message as JSON
-				buf := bytes.NewBuffer([]byte{})
-				encoder := json.NewEncoder(buf)
-				msg := map[string]string{
-					"text": fmt.Sprintf("*New temporary OpenShift 4.1 cluster*\n"+
-						"*URL*: `https://console-openshift-console.apps.%s.devcluster.openshift.com`\n"+
-						"*Username*: `kubeadmin`\n"+
-						"*Password*: `%s`",
-						cluster.Name, string(kubeadminPw)),
-				}
-				if err := encoder.Encode(msg); err != nil {
-					logger.Fatalf("failed to encode Slack message as JSON: %s",
-						err.Error())
+					actionFailed("failed to read credentials of cluster %s: %s",
+						cluster.Name, err.Error())
+				} else {
+					if len(creds.ConsoleURL) == 0 {
+						creds.ConsoleURL = fmt.Sprintf("https://console-openshift-console."+
+							"apps.%s.devcluster.openshift.com", cluster.Name)
+					}
+
+					// {{{6 Send to Slack
+					err := postSlack(cfg.Slack.IncomingWebhook, fmt.Sprintf(
+						"*New temporary OpenShift 4.1 cluster*\n"+
+							"*URL*: `%s`\n"+
+							"*Username*: `kubeadmin`\n"+
+							"*Password*: `%s`",
+						creds.ConsoleURL, creds.KubeadminPassword))
+					if err != nil {
+						actionFailed("failed to post Slack message for cluster %s: %s",
+							cluster.Name, err.Error())
+					}
 				}
 
-				// {{{6 Send to Slack
-				_, err = http.Post(cfg.Slack.IncomingWebhook, "application/json", buf)
-				if err != nil {
-					logger.Fatalf("failed to post Slack message for cluster %s: %s",
-						cluster.Name, err.Error())
+				// {{{5 Check console before pointing DNS at cluster
+				if cfg.Health.ConsoleCheck {
+					if err := checkConsole(logger, cfg, cluster.Name); err != nil {
+						logger.Printf("WARNING: new cluster %s failed console check, not "+
+							"pointing DNS at it or deleting cluster %s which DNS points "+
+							"to, will retry next control loop: %s", cluster.Name,
+							recordsCluster, err.Error())
+
+						cfDNSPlan.Set = []CFDNSRecord{}
+
+						deletes := []Cluster{}
+						for _, c := range osInstallPlan.Delete {
+							if c.Name != recordsCluster {
+								deletes = append(deletes, c)
+							}
+						}
+						osInstallPlan.Delete = deletes
+					} else {
+						logger.Printf("new cluster %s passed console check", cluster.Name)
+					}
 				}
 			}
 
 			// {{{4 Helm chart install
 			logger.Printf("execute Helm chart install")
-			if helmPlan != nil {
+			if helmPlan != nil && !pastDeadline() {
 				if flags.DryRun {
 					logger.Printf("would exec %s -s %s -c %s -n %s %s",
 						installHelmChartScript,
@@ -712,20 +5944,41 @@ func main() {
 						"-n", helmPlan.Namespace,
 						helmPlan.ChartGitURI)
 					err := runCmd(loggerChild(logger, "helm-install.stdout"),
-						loggerChild(logger, "helm-install.stderr"), cmd)
+						loggerChild(logger, "helm-install.stderr"), cmd, 0, 0)
 					if err != nil {
-						logger.Fatalf("failed to install Helm chart \"%s\" in the \"%s\" namespace on the \"%s\" cluster",
+						logEvent(logger, LogEvent{
+							Event:   "error",
+							LoopID:  loopID,
+							Cluster: helmPlan.Cluster.Name,
+							Action:  "helm_install",
+							Error:   err.Error(),
+						})
+						actionFailed("failed to install Helm chart \"%s\" in the \"%s\" namespace on the \"%s\" cluster: %s",
+							helmPlan.ChartGitURI, helmPlan.Namespace, helmPlan.Cluster.Name,
+							err.Error())
+						execResult.Record("helm_install", helmPlan.Cluster.Name, "failed")
+
+						// DNS is not pointed away from, and clusters are not
+						// deleted, before the chart is migrated
+						logger.Print("not executing rest of plan since installing " +
+							"Helm chart failed")
+						cfDNSPlan.Set = []CFDNSRecord{}
+						osInstallPlan.Delete = []Cluster{}
+					} else {
+						logger.Printf("installed Helm chart \"%s\" in the \"%s\" namespace on the \"%s\" cluster",
 							helmPlan.ChartGitURI, helmPlan.Namespace, helmPlan.Cluster.Name)
+						execResult.Record("helm_install", helmPlan.Cluster.Name, "completed")
 					}
-
-					logger.Printf("installed Helm chart \"%s\" in the \"%s\" namespace on the \"%s\" cluster",
-						helmPlan.ChartGitURI, helmPlan.Namespace, helmPlan.Cluster.Name)
 				}
 			}
 
 			// {{{4 CloudflareDNS
 			logger.Print("execute Cloudflare DNS set")
 			for _, record := range cfDNSPlan.Set {
+				if pastDeadline() {
+					break
+				}
+
 				if flags.DryRun {
 					logger.Printf("would set Cloudflare DNS record %s=%s",
 						record.Record.Name, record.Record.Content)
@@ -735,43 +5988,255 @@ func main() {
 				err := cf.UpdateDNSRecord(cfg.Cloudflare.ZoneID, record.Record.ID,
 					record.Record)
 				if err != nil {
-					logger.Fatalf("failed to update Cloudflare DNS record %s: %s",
+					logEvent(logger, LogEvent{
+						Event:   "error",
+						LoopID:  loopID,
+						Cluster: record.ClusterName,
+						Action:  "dns_set",
+						Error:   err.Error(),
+					})
+					actionFailed("failed to update Cloudflare DNS record %s: %s",
 						record.Record.Name, err.Error())
+					execResult.Record("dns_set", record.Record.Name, "failed")
+
+					// The record still points to its cluster, so it is not deleted
+					deletes := []Cluster{}
+					for _, c := range osInstallPlan.Delete {
+						if c.Name != record.ClusterName {
+							deletes = append(deletes, c)
+						}
+					}
+					osInstallPlan.Delete = deletes
+					continue
 				}
 
 				logger.Printf("updated Cloudflare DNS record.Name=%s to record.Content=%s",
 					record.Record.Name, record.Record.Content)
+				execResult.Record("dns_set", record.Record.Name, "completed")
 			}
 
 			// {{{4 OpenShift install delete
 			logger.Printf("execute OpenShift install delete")
 			for _, cluster := range osInstallPlan.Delete {
+				if pastDeadline() {
+					break
+				}
+
 				// {{{5 Dry run
 				if flags.DryRun {
-					logger.Printf("would exec %s -s %s -a delete -n %s",
+					if len(cfg.Hooks.PreDelete) > 0 {
+						logger.Printf("would run pre delete hook: %s",
+							cfg.Hooks.PreDelete)
+					}
+
+					logger.Printf("would exec %s -s %s -a delete -n %s -l %s",
 						runOpenShiftInstallScript,
 						cfg.OpenShiftInstall.StateStorePath,
-						cluster.Name)
+						cluster.Name, destroyLogLevel(cfg))
+					continue
+				}
+
+				// {{{5 Check metadata
+				// openshift-install cannot delete a cluster without its metadata,
+				// retrying will not change that
+				if err := backupMetadata(cfg, cluster.Name); err == errNoMetadata {
+					logEvent(logger, LogEvent{
+						Event:   "error",
+						LoopID:  loopID,
+						Cluster: cluster.Name,
+						Action:  "delete",
+						Error:   err.Error(),
+					})
+					logger.Printf("WARNING: not deleting cluster %s, state directory "+
+						"has no metadata: %s", cluster.Name, err.Error())
+					execResult.Record("delete", cluster.Name, "failed")
+					audit("delete", cluster, "failed")
 					continue
 				}
 
+				// {{{5 Run pre delete hook
+				if len(cfg.Hooks.PreDelete) > 0 {
+					err := runHook(logger, cfg, "pre-delete-hook", cfg.Hooks.PreDelete,
+						cluster)
+					if err != nil {
+						logEvent(logger, LogEvent{
+							Event:   "error",
+							LoopID:  loopID,
+							Cluster: cluster.Name,
+							Action:  "pre_delete_hook",
+							Error:   err.Error(),
+						})
+					}
+
+					if err != nil && cfg.Hooks.PreDeleteFailure == "abort" {
+						logger.Printf("WARNING: pre delete hook failed for cluster %s, "+
+							"not deleting cluster: %s", cluster.Name, err.Error())
+						execResult.Record("delete", cluster.Name, "failed")
+						audit("delete", cluster, "failed")
+						continue
+					} else if err != nil {
+						logger.Printf("WARNING: pre delete hook failed for cluster %s, "+
+							"deleting cluster anyway: %s", cluster.Name, err.Error())
+					} else {
+						logger.Printf("ran pre delete hook for cluster %s", cluster.Name)
+					}
+				}
+
+				// {{{5 Wait for cooldown
+				deleteCooldown := time.Duration(cfg.Cluster.DeleteCooldown *
+					float64(time.Second))
+				wait := deleteCooldown - time.Since(lastInstallEnd)
+				if !lastInstallEnd.IsZero() && wait > 0 {
+					logger.Printf("waiting %s before deleting cluster %s, "+
+						"Cluster.DeleteCooldown", wait.String(), cluster.Name)
+					time.Sleep(wait)
+				}
+
 				// {{{5 Delete
-				cmd := exec.Command(runOpenShiftInstallScript,
-					"-s", cfg.OpenShiftInstall.StateStorePath,
-					"-a", "delete",
-					"-n", cluster.Name)
-				err := runCmd(loggerChild(logger, "openshift-install.delete.stdout"),
-					loggerChild(logger, "openshift-install.delete.stderr"), cmd)
+				deleteStart := time.Now()
+				if keys := installEnvKeys(cfg); len(keys) > 0 {
+					logger.Printf("setting openshift-install environment variables: %s",
+						strings.Join(keys, ", "))
+				}
+
+				err := retryBackoff(logger, fmt.Sprintf("delete cluster %s",
+					cluster.Name), cfg.Cluster.DeleteAttempts,
+					time.Duration(cfg.Cluster.DeleteBackoff*float64(time.Second)),
+					func() error {
+						// A failed delete can leave the state directory without
+						// the metadata.json needed to retry
+						if err := backupMetadata(cfg, cluster.Name); err != nil {
+							return fmt.Errorf("failed to back up metadata: %s",
+								err.Error())
+						}
+
+						cmd := exec.Command(runOpenShiftInstallScript,
+							"-s", cfg.OpenShiftInstall.StateStorePath,
+							"-a", "delete",
+							"-n", cluster.Name,
+							"-l", destroyLogLevel(cfg))
+						env, err := awsCredsEnv(installEnv(cfg), assumedCreds)
+						if err != nil {
+							return fmt.Errorf("failed to get environment: %s",
+								err.Error())
+						}
+						cmd.Env = env
+
+						destroyLog, closeDestroyLog := openClusterLog(logger, cfg,
+							cluster.Name, "destroy.log", false)
+						defer closeDestroyLog()
+
+						return runCmd(
+							loggerTee(loggerChild(logger,
+								"openshift-install.delete.stdout"), destroyLog),
+							loggerTee(loggerChild(logger,
+								"openshift-install.delete.stderr"), destroyLog),
+							cmd, installIdleTimeout(cfg), 0)
+					})
+				lastInstallEnd = time.Now()
 				if err != nil {
-					logger.Fatalf("failed to delete cluster %s: %s",
-						cluster.Name, err.Error())
+					logEvent(logger, LogEvent{
+						Event:   "error",
+						LoopID:  loopID,
+						Cluster: cluster.Name,
+						Action:  "delete",
+						Error:   err.Error(),
+					})
+					audit("delete", cluster, "failed")
+
+					if err := writeDestroyFailed(cfg, cluster.Name,
+						cfg.Cluster.DeleteAttempts, err); err != nil {
+						logger.Printf("failed to record failed delete in state "+
+							"directory of cluster %s: %s", cluster.Name, err.Error())
+					}
+
+					actionFailed("failed to delete cluster %s after %d attempt(s), "+
+						"see %s in its state directory: %s", cluster.Name,
+						cfg.Cluster.DeleteAttempts, destroyFailedFile, err.Error())
+					execResult.Record("delete", cluster.Name, "failed")
+					continue
+				}
+
+				// Remove breadcrumbs of previous failed deletes
+				for _, file := range []string{metadataBackupFile, destroyFailedFile} {
+					err := os.Remove(filepath.Join(cfg.OpenShiftInstall.StateStorePath,
+						cluster.Name, file))
+					if err != nil && !os.IsNotExist(err) {
+						logger.Printf("failed to remove %s from state directory of "+
+							"cluster %s: %s", file, cluster.Name, err.Error())
+					}
 				}
 
 				logger.Printf("delete cluster %s", cluster.Name)
+				execResult.Record("delete", cluster.Name, "completed")
+				audit("delete", cluster, "completed")
+				logEvent(logger, LogEvent{
+					Event:    "delete",
+					LoopID:   loopID,
+					Cluster:  cluster.Name,
+					Action:   "delete",
+					Duration: time.Since(deleteStart).Seconds(),
+				})
+			}
+
+			// {{{3 Summarize execution
+			if !flags.DryRun {
+				for _, outcome := range execResult.Outcomes {
+					metrics.Add("auto_cluster_actions_total",
+						fmt.Sprintf("action=\"%s\",outcome=\"%s\"", outcome.Action,
+							outcome.Outcome), 1)
+				}
+
+				if execResult.Diverged() {
+					outcomeStrs := []string{}
+					for _, outcome := range execResult.Outcomes {
+						if outcome.Outcome != "completed" {
+							outcomeStrs = append(outcomeStrs, fmt.Sprintf("%s %s %s",
+								outcome.Action, outcome.Target, outcome.Outcome))
+						}
+					}
+
+					logger.Printf("WARNING: plan was not fully executed, %s, not "+
+						"completed: %s", execResult.String(),
+						strings.Join(outcomeStrs, ", "))
+				} else {
+					logger.Printf("plan executed, %s", execResult.String())
+				}
+			}
+
+			logEvent(logger, LogEvent{
+				Event:    "loop_end",
+				LoopID:   loopID,
+				Duration: time.Since(loopStart).Seconds(),
+			})
+
+			metrics.Set("auto_cluster_create_failures", "",
+				float64(createBreaker.Failures()))
+			breakerOpen := 0.0
+			if createBreaker.Open() {
+				breakerOpen = 1
+			}
+			metrics.Set("auto_cluster_create_breaker_open", "", breakerOpen)
+
+			if len(actionErrs) > 0 {
+				logger.Printf("WARNING: %d action(s) failed during control loop "+
+					"execution, Loop.ContinueOnError is true so the next execution "+
+					"will run as usual: %s", len(actionErrs),
+					strings.Join(actionErrs, "; "))
+			}
+
+			if !createFailed && len(actionErrs) == 0 {
+				loopStatus.Succeeded()
+				metrics.Set("auto_cluster_last_success_timestamp_seconds", "",
+					float64(loopStatus.LastSuccess().Unix()))
 			}
 
 			// {{{2 Determine when to run next control loop
 			if flags.Once {
+				if createFailed {
+					logger.Fatal("ran control loop once, failed to create cluster")
+				}
+
 				logger.Print("ran control loop once, exiting")
 				os.Exit(0)
 			} else {
@@ -0,0 +1,2140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	ec2Svc "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	startedOn := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	staleAge := time.Minute * 90
+
+	tests := []struct {
+		name        string
+		lastSuccess time.Time
+		now         time.Time
+		status      int
+		body        string
+	}{
+		{
+			name:   "fresh without success",
+			now:    startedOn.Add(time.Minute * 30),
+			status: http.StatusOK,
+			body:   "ready, last successful control loop execution: never",
+		},
+		{
+			name:   "stale without success",
+			now:    startedOn.Add(time.Minute * 91),
+			status: http.StatusServiceUnavailable,
+			body:   "not ready, last successful control loop execution: never",
+		},
+		{
+			name:        "fresh",
+			lastSuccess: startedOn.Add(time.Hour * 2),
+			now:         startedOn.Add(time.Hour * 3),
+			status:      http.StatusOK,
+			body:        "ready, last successful control loop execution: 2019-07-01T14:00:00Z",
+		},
+		{
+			name:        "stale",
+			lastSuccess: startedOn.Add(time.Hour * 2),
+			now:         startedOn.Add(time.Hour * 4),
+			status:      http.StatusServiceUnavailable,
+			body:        "not ready, last successful control loop execution: 2019-07-01T14:00:00Z",
+		},
+		{
+			name:        "exactly stale age",
+			lastSuccess: startedOn.Add(time.Hour * 2),
+			now:         startedOn.Add(time.Hour*2 + staleAge),
+			status:      http.StatusOK,
+			body:        "ready, last successful control loop execution: 2019-07-01T14:00:00Z",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := &LoopStatus{
+				startedOn:   startedOn,
+				lastSuccess: test.lastSuccess,
+				now:         func() time.Time { return test.now },
+			}
+
+			resp := httptest.NewRecorder()
+			readyzHandler(status, &CreateBreaker{}, staleAge)(resp,
+				httptest.NewRequest("GET", "/readyz", nil))
+
+			if resp.Code != test.status {
+				t.Errorf("status: got %d, expected %d", resp.Code, test.status)
+			}
+
+			if body := resp.Body.String(); body != test.body {
+				t.Errorf("body: got \"%s\", expected \"%s\"", body, test.body)
+			}
+		})
+	}
+}
+
+func TestReadyzHandlerCreatePaused(t *testing.T) {
+	status := NewLoopStatus()
+	status.Succeeded()
+
+	breaker := &CreateBreaker{}
+	breaker.SetCooldown(time.Hour)
+	breaker.Trip()
+
+	resp := httptest.NewRecorder()
+	readyzHandler(status, breaker, time.Minute)(resp,
+		httptest.NewRequest("GET", "/readyz", nil))
+
+	if resp.Code != http.StatusOK {
+		t.Errorf("status: got %d, expected %d", resp.Code, http.StatusOK)
+	}
+
+	if !strings.HasSuffix(resp.Body.String(), "cluster creation paused after 1 "+
+		"failures in a row") {
+		t.Errorf("body does not report paused cluster creation: \"%s\"",
+			resp.Body.String())
+	}
+}
+
+// testInstance returns a described EC2 instance, tags are pairs of keys and values
+func testInstance(id, state string, launchTime time.Time,
+	tags ...string) *ec2Svc.Instance {
+
+	codes := map[string]int64{
+		"pending":    0,
+		"running":    16,
+		"stopped":    80,
+		"terminated": 48,
+	}
+
+	instance := &ec2Svc.Instance{
+		InstanceId: aws.String(id),
+		LaunchTime: aws.Time(launchTime),
+		State: &ec2Svc.InstanceState{
+			Code: aws.Int64(codes[state]),
+			Name: aws.String(state),
+		},
+	}
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		instance.Tags = append(instance.Tags, &ec2Svc.Tag{
+			Key:   aws.String(tags[i]),
+			Value: aws.String(tags[i+1]),
+		})
+	}
+
+	return instance
+}
+
+// withTag adds a tag to an instance
+func withTag(instance *ec2Svc.Instance, tag *ec2Svc.Tag) *ec2Svc.Instance {
+	instance.Tags = append(instance.Tags, tag)
+	return instance
+}
+
+// tempDir makes a temporary directory, the caller must remove it
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "auto-cluster-test")
+	if err != nil {
+		t.Fatalf("failed to make temporary directory: %s", err.Error())
+	}
+
+	return dir
+}
+
+func TestInstanceGrouper(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	cfg := Config{}
+	cfg.Cluster.NamePrefix = "auto-cluster-"
+	cfg.OpenShiftInstall.StateStorePath = tempDir(t)
+	defer os.RemoveAll(cfg.OpenShiftInstall.StateStorePath)
+
+	tests := []struct {
+		name              string
+		requireRunning    bool
+		requireManagedTag bool
+		reapOrphans       bool
+		instances         []*ec2Svc.Instance
+		clusters          map[string]Cluster
+		orphans           []string
+	}{
+		{
+			name: "several clusters",
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour*3),
+					"Name", "auto-cluster-1-abcde-master-0"),
+				testInstance("i-2", "running", now.Add(-time.Hour*2),
+					"Name", "auto-cluster-1-abcde-worker-0"),
+				testInstance("i-3", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-master-0",
+					IgnoreTagKey, "true"),
+				testInstance("i-4", "pending", now.Add(-time.Minute),
+					"Name", "auto-cluster-3-klmno-master-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-1": {
+					Name:             "auto-cluster-1",
+					Age:              time.Hour * 3,
+					DNSPointed:       true,
+					Healthy:          true,
+					InfraID:          "auto-cluster-1-abcde",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+				"auto-cluster-2": {
+					Name:             "auto-cluster-2",
+					Age:              time.Hour,
+					Healthy:          true,
+					Ignored:          true,
+					InfraID:          "auto-cluster-2-fghij",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+				"auto-cluster-3": {
+					Name:             "auto-cluster-3",
+					Age:              time.Minute,
+					Healthy:          true,
+					InfraID:          "auto-cluster-3-klmno",
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name: "untagged instances",
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour)),
+				testInstance("i-2", "running", now.Add(-time.Hour),
+					ClusterOwnedTagPrefix+"auto-cluster-4-pqrst", "owned"),
+				testInstance("i-3", "running", now.Add(-time.Hour),
+					"Name", "other-1-abcde-master-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-4": {
+					Name:             "auto-cluster-4",
+					Age:              time.Hour,
+					Healthy:          true,
+					InfraID:          "auto-cluster-4-pqrst",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name:              "untagged instances with RequireManagedTag",
+			requireManagedTag: true,
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-1-abcde-master-0"),
+				testInstance("i-2", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-master-0",
+					ManagedTagKey, "true"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-2": {
+					Name:             "auto-cluster-2",
+					Age:              time.Hour,
+					Healthy:          true,
+					InfraID:          "auto-cluster-2-fghij",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name: "terminated instances",
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "terminated", now.Add(-time.Hour),
+					"Name", "auto-cluster-1-abcde-master-0"),
+				testInstance("i-2", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-master-0"),
+				testInstance("i-3", "stopped", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-worker-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-2": {
+					Name:             "auto-cluster-2",
+					Age:              time.Hour,
+					Healthy:          true,
+					InfraID:          "auto-cluster-2-fghij",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name:           "terminated instances with RequireRunning",
+			requireRunning: true,
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-master-0"),
+				testInstance("i-2", "terminated", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-worker-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-2": {
+					Name:             "auto-cluster-2",
+					Age:              time.Hour,
+					Healthy:          true,
+					InfraID:          "auto-cluster-2-fghij",
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name: "same instance found twice",
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-1-abcde-master-0"),
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-1-abcde-master-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-1": {
+					Name:             "auto-cluster-1",
+					Age:              time.Hour,
+					DNSPointed:       true,
+					Healthy:          true,
+					InfraID:          "auto-cluster-1-abcde",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name: "cluster name cannot be extracted",
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-1"),
+				testInstance("i-2", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-2-fghij-master-0"),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-2": {
+					Name:             "auto-cluster-2",
+					Age:              time.Hour,
+					Healthy:          true,
+					InfraID:          "auto-cluster-2-fghij",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name: "tags without keys or values",
+			instances: []*ec2Svc.Instance{
+				withTag(withTag(testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-1-abcde-master-0"),
+					&ec2Svc.Tag{Key: aws.String(IgnoreTagKey)}),
+					&ec2Svc.Tag{Value: aws.String("true")}),
+			},
+			clusters: map[string]Cluster{
+				"auto-cluster-1": {
+					Name:             "auto-cluster-1",
+					Age:              time.Hour,
+					DNSPointed:       true,
+					Healthy:          true,
+					InfraID:          "auto-cluster-1-abcde",
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+		},
+		{
+			name:        "orphans",
+			reapOrphans: true,
+			instances: []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "old-prefix-1-abcde-master-0", ManagedTagKey, "true"),
+				testInstance("i-2", "running", now.Add(-time.Hour),
+					"Name", "old-prefix-2-abcde-master-0", ManagedTagKey, "true",
+					IgnoreTagKey, "true"),
+				testInstance("i-3", "running", now.Add(-time.Hour),
+					"Name", "unmanaged-1-abcde-master-0"),
+			},
+			clusters: map[string]Cluster{},
+			orphans:  []string{"old-prefix-1-abcde-master-0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testCfg := cfg
+			testCfg.Cluster.RequireRunning = test.requireRunning
+			testCfg.Cluster.RequireManagedTag = test.requireManagedTag
+
+			grouper := NewInstanceGrouper(log.New(ioutil.Discard, "", 0), testCfg,
+				Flags{ReapOrphans: test.reapOrphans}, "auto-cluster-1",
+				func() time.Time { return now })
+			for _, instance := range test.instances {
+				grouper.Add(instance)
+			}
+
+			if !reflect.DeepEqual(grouper.Clusters, test.clusters) {
+				t.Errorf("clusters: got %v, expected %v", grouper.Clusters,
+					test.clusters)
+			}
+
+			orphans := []string{}
+			for _, instance := range grouper.Orphans {
+				orphans = append(orphans, instance.Name)
+			}
+			if len(test.orphans) == 0 {
+				test.orphans = []string{}
+			}
+			if !reflect.DeepEqual(orphans, test.orphans) {
+				t.Errorf("orphans: got %v, expected %v", orphans, test.orphans)
+			}
+		})
+	}
+}
+
+// planTest is a planClusters test case, cluster names are without the
+// "auto-cluster-" prefix
+type planTest struct {
+	name string
+
+	// cfg changes the default test configuration
+	cfg func(cfg *Config)
+
+	clusters []Cluster
+	orphans  []Cluster
+	state    PlanState
+
+	// nextNameErr is returned by PlanState.NextName if not nil
+	nextNameErr error
+
+	create  []string
+	delete  []string
+	primary string
+	err     bool
+}
+
+// testPlanNow is the time planClusters tests plan at
+var testPlanNow = time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+// testCluster returns a healthy running cluster which is age hours old
+func testCluster(name string, age float64) Cluster {
+	return Cluster{
+		Name:             "auto-cluster-" + name,
+		Age:              time.Duration(age * float64(time.Hour)),
+		Healthy:          true,
+		Running:          true,
+		ConsoleReachable: true,
+	}
+}
+
+// clusterNames returns the names of clusters without the "auto-cluster-" prefix
+func clusterNames(clusters []Cluster) []string {
+	names := []string{}
+	for _, cluster := range clusters {
+		names = append(names, strings.TrimPrefix(cluster.Name, "auto-cluster-"))
+	}
+
+	return names
+}
+
+// runPlanTests runs planClusters test cases
+func runPlanTests(t *testing.T, tests []planTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Cluster.NamePrefix = "auto-cluster-"
+			cfg.Cluster.OldestAge = 42
+			cfg.Cluster.MaxDeletes = 3
+			cfg.Health.UnhealthyLimit = 3
+			if test.cfg != nil {
+				test.cfg(&cfg)
+			}
+
+			clusters := map[string]Cluster{}
+			for _, cluster := range test.clusters {
+				clusters[cluster.Name] = cluster
+			}
+
+			orphans := map[string]Cluster{}
+			for _, cluster := range test.orphans {
+				orphans[cluster.Name] = cluster
+			}
+
+			state := test.state
+			state.Logger = log.New(ioutil.Discard, "", 0)
+			state.NextName = func() (string, error) {
+				if test.nextNameErr != nil {
+					return "", test.nextNameErr
+				}
+				return "auto-cluster-new", nil
+			}
+			if len(state.RecordsCluster) > 0 {
+				state.RecordsCluster = "auto-cluster-" + state.RecordsCluster
+			}
+
+			plan, primary, reasons, err := planClusters(clusters, orphans, cfg,
+				testPlanNow, state)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if test.create == nil {
+				test.create = []string{}
+			}
+			if create := clusterNames(plan.Create); !reflect.DeepEqual(create,
+				test.create) {
+				t.Errorf("create: got %v, expected %v", create, test.create)
+			}
+
+			if test.delete == nil {
+				test.delete = []string{}
+			}
+			if del := clusterNames(plan.Delete); !reflect.DeepEqual(del,
+				test.delete) {
+				t.Errorf("delete: got %v, expected %v", del, test.delete)
+			}
+
+			primaryName := ""
+			if primary != nil {
+				primaryName = strings.TrimPrefix(primary.Name, "auto-cluster-")
+
+				if _, ok := reasons[primary.Name]; !ok {
+					t.Errorf("no primary reason for primary cluster %s",
+						primary.Name)
+				}
+			}
+			if primaryName != test.primary {
+				t.Errorf("primary: got \"%s\", expected \"%s\"", primaryName,
+					test.primary)
+			}
+
+			// The primary cluster must never be deleted
+			for _, cluster := range plan.Delete {
+				if primary != nil && cluster.Name == primary.Name {
+					t.Errorf("primary cluster %s is planned to be deleted",
+						primary.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanClusters(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name:    "zero clusters",
+			create:  []string{"new"},
+			primary: "new",
+		},
+		{
+			name: "all clusters too old",
+			clusters: []Cluster{
+				testCluster("01", 43),
+				testCluster("02", 45),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			create:  []string{"new"},
+			delete:  []string{"02", "01"},
+			primary: "new",
+		},
+		{
+			name: "all clusters too old and creation paused",
+			clusters: []Cluster{
+				testCluster("01", 43),
+				testCluster("02", 45),
+			},
+			state:  PlanState{RecordsCluster: "01", CreatePaused: true},
+			delete: []string{"02"},
+		},
+		{
+			name: "all clusters too old and not enough free space",
+			clusters: []Cluster{
+				testCluster("01", 43),
+			},
+			state: PlanState{
+				RecordsCluster: "01",
+				FreeSpaceErr:   fmt.Errorf("not enough free space"),
+			},
+		},
+		{
+			name: "count increase to replace unhealthy cluster",
+			clusters: []Cluster{
+				testCluster("01", 10),
+			},
+			state: PlanState{
+				RecordsCluster:  "01",
+				UnhealthyCounts: map[string]uint{"auto-cluster-01": 3},
+			},
+			create:  []string{"new"},
+			delete:  []string{"01"},
+			primary: "new",
+		},
+		{
+			name: "count increase to rotate primary",
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testCluster("02", 5),
+			},
+			state:   PlanState{RecordsCluster: "02", RotatePrimary: true},
+			create:  []string{"new"},
+			delete:  []string{"01", "02"},
+			primary: "new",
+		},
+		{
+			name: "count decrease",
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testCluster("02", 5),
+				testCluster("03", 2),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"01", "02"},
+			primary: "03",
+		},
+		{
+			name: "count decrease prefers healthy clusters",
+			clusters: []Cluster{
+				testCluster("01", 10),
+				{
+					Name:             "auto-cluster-02",
+					Age:              time.Hour * 2,
+					Running:          true,
+					ConsoleReachable: true,
+				},
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"02"},
+			primary: "01",
+		},
+		{
+			name: "primary exactly at MinPrimaryAge",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.MinPrimaryAge = 2
+			},
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testCluster("02", 2),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "primary just under MinPrimaryAge",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.MinPrimaryAge = 2
+			},
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testCluster("02", 1.99),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "01",
+		},
+		{
+			name: "primary exactly at OldestAge",
+			clusters: []Cluster{
+				testCluster("01", 42),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "01",
+		},
+		{
+			name: "next name error when creating",
+			clusters: []Cluster{
+				testCluster("01", 43),
+			},
+			nextNameErr: fmt.Errorf("invalid state directory"),
+			err:         true,
+		},
+		{
+			name: "next name error when not creating",
+			clusters: []Cluster{
+				testCluster("01", 10),
+			},
+			nextNameErr: fmt.Errorf("invalid state directory"),
+			primary:     "01",
+		},
+	})
+}
+
+func TestPlanClustersDeleteOrder(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name: "oldest first",
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 47),
+				testCluster("03", 45),
+				testCluster("04", 1),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"02", "03", "01"},
+			primary: "04",
+		},
+		{
+			name: "equal ages ordered by name",
+			clusters: []Cluster{
+				testCluster("03", 44),
+				testCluster("01", 44),
+				testCluster("02", 44),
+				testCluster("04", 1),
+			},
+			state:   PlanState{RecordsCluster: "04"},
+			delete:  []string{"01", "02", "03"},
+			primary: "04",
+		},
+		{
+			name: "MaxDeletes keeps oldest",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.MaxDeletes = 2
+			},
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 47),
+				testCluster("03", 45),
+				testCluster("04", 46),
+				testCluster("05", 1),
+			},
+			state:   PlanState{RecordsCluster: "05"},
+			delete:  []string{"02", "04"},
+			primary: "05",
+		},
+		{
+			name: "MaxDeletes with equal ages",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.MaxDeletes = 1
+			},
+			clusters: []Cluster{
+				testCluster("02", 44),
+				testCluster("01", 44),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"01"},
+			primary: "03",
+		},
+		{
+			name: "primary not deleted when young clusters are reduced",
+			clusters: []Cluster{
+				testCluster("01", 3),
+				testCluster("02", 2),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"01", "02"},
+			primary: "03",
+		},
+		{
+			name: "primary not deleted when it is an orphan too",
+			clusters: []Cluster{
+				testCluster("01", 3),
+			},
+			orphans: []Cluster{
+				testCluster("01", 3),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "01",
+		},
+	})
+}
+
+// testUnhealthyCluster returns a running cluster which failed its health probe
+func testUnhealthyCluster(name string, age float64) Cluster {
+	cluster := testCluster(name, age)
+	cluster.Healthy = false
+
+	return cluster
+}
+
+func TestPlanClustersMinHealthy(t *testing.T) {
+	minHealthy := func(minHealthy, maxDeletes uint) func(cfg *Config) {
+		return func(cfg *Config) {
+			cfg.Cluster.MinHealthy = minHealthy
+			cfg.Cluster.MaxDeletes = maxDeletes
+			cfg.Health.Probe = true
+		}
+	}
+
+	runPlanTests(t, []planTest{
+		{
+			name: "unhealthy clusters not counted",
+			cfg:  minHealthy(1, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testUnhealthyCluster("02", 1),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "02",
+		},
+		{
+			name: "unhealthy clusters deleted",
+			cfg:  minHealthy(5, 3),
+			clusters: []Cluster{
+				testUnhealthyCluster("01", 44),
+				testCluster("02", 1),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "orphaned clusters not counted and deleted",
+			cfg:  minHealthy(2, 3),
+			clusters: []Cluster{
+				testCluster("01", 1),
+			},
+			orphans: []Cluster{
+				testCluster("old", 5),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"old"},
+			primary: "01",
+		},
+		{
+			name: "clusters without instances not counted and deleted",
+			cfg:  minHealthy(2, 3),
+			clusters: []Cluster{
+				testCluster("01", 1),
+			},
+			state: PlanState{
+				RecordsCluster: "01",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-02": testCluster("02", 5),
+				},
+			},
+			delete:  []string{"02"},
+			primary: "01",
+		},
+		{
+			name: "healthy count above MinHealthy",
+			cfg:  minHealthy(1, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"02", "01"},
+			primary: "03",
+		},
+		{
+			name: "healthy count reaches MinHealthy",
+			cfg:  minHealthy(2, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"02"},
+			primary: "03",
+		},
+		{
+			name: "healthy count equals MinHealthy",
+			cfg:  minHealthy(3, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			primary: "03",
+		},
+		{
+			name: "MinHealthy then MaxDeletes",
+			cfg:  minHealthy(2, 1),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 46),
+				testCluster("04", 1),
+				testUnhealthyCluster("05", 46.5),
+			},
+			state:   PlanState{RecordsCluster: "04"},
+			delete:  []string{"05"},
+			primary: "04",
+		},
+		{
+			name: "MaxDeletes above deletions MinHealthy allows",
+			cfg:  minHealthy(2, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 46),
+				testCluster("04", 1),
+				testUnhealthyCluster("05", 46.5),
+			},
+			state:   PlanState{RecordsCluster: "04"},
+			delete:  []string{"05", "03", "02"},
+			primary: "04",
+		},
+		{
+			name: "ignored clusters not counted",
+			cfg:  minHealthy(2, 3),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testIgnoredCluster("02", 1),
+				testIgnoredCluster("03", 2),
+				testCluster("04", 1),
+			},
+			state:   PlanState{RecordsCluster: "04"},
+			primary: "04",
+		},
+		{
+			name: "clusters left alone by RequireRunning not counted",
+			cfg: func(cfg *Config) {
+				minHealthy(2, 3)(cfg)
+				cfg.Cluster.RequireRunning = true
+			},
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testStoppedCluster("02", 1),
+				testStoppedCluster("03", 2),
+				testCluster("04", 1),
+			},
+			state:   PlanState{RecordsCluster: "04"},
+			primary: "04",
+		},
+	})
+}
+
+func TestPlanClustersMinHealthyWithoutProbe(t *testing.T) {
+	minHealthy := func(minHealthy uint) func(cfg *Config) {
+		return func(cfg *Config) {
+			cfg.Cluster.MinHealthy = minHealthy
+		}
+	}
+
+	// Without health probes running clusters are healthy
+	runPlanTests(t, []planTest{
+		{
+			name: "running clusters counted",
+			cfg:  minHealthy(2),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"02"},
+			primary: "03",
+		},
+		{
+			name: "stopped clusters not counted and deleted",
+			cfg:  minHealthy(2),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testStoppedCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"02"},
+			primary: "03",
+		},
+		{
+			name: "health probe results not used",
+			cfg:  minHealthy(2),
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testUnhealthyCluster("02", 45),
+				testCluster("03", 1),
+			},
+			state:   PlanState{RecordsCluster: "03"},
+			delete:  []string{"02"},
+			primary: "03",
+		},
+	})
+}
+
+// testStoppedCluster returns a cluster whose instances are not all running
+func testStoppedCluster(name string, age float64) Cluster {
+	cluster := testCluster(name, age)
+	cluster.Running = false
+
+	return cluster
+}
+
+// testIgnoredCluster returns a cluster with the IgnoreTagKey tag
+func testIgnoredCluster(name string, age float64) Cluster {
+	cluster := testCluster(name, age)
+	cluster.Ignored = true
+
+	return cluster
+}
+
+func TestPlanClustersIgnored(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name: "too old",
+			clusters: []Cluster{
+				testIgnoredCluster("01", 47),
+				testCluster("02", 1),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			primary: "02",
+		},
+		{
+			name: "expired",
+			clusters: []Cluster{
+				func() Cluster {
+					cluster := testIgnoredCluster("01", 1)
+					cluster.ExpiresAt = testPlanNow.Add(-time.Hour)
+					return cluster
+				}(),
+				testCluster("02", 1),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			primary: "02",
+		},
+		{
+			name: "unhealthy",
+			clusters: []Cluster{
+				testIgnoredCluster("01", 1),
+				testCluster("02", 2),
+			},
+			state: PlanState{
+				RecordsCluster:  "02",
+				UnhealthyCounts: map[string]uint{"auto-cluster-01": 5},
+			},
+			primary: "02",
+		},
+		{
+			name: "younger than primary",
+			clusters: []Cluster{
+				testIgnoredCluster("01", 1),
+				testCluster("02", 5),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			primary: "02",
+		},
+		{
+			name: "only cluster",
+			clusters: []Cluster{
+				testIgnoredCluster("01", 1),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			create:  []string{"new"},
+			primary: "new",
+		},
+		{
+			name: "rotating primary",
+			clusters: []Cluster{
+				testIgnoredCluster("01", 1),
+				testCluster("02", 5),
+			},
+			state:   PlanState{RecordsCluster: "02", RotatePrimary: true},
+			create:  []string{"new"},
+			delete:  []string{"02"},
+			primary: "new",
+		},
+	})
+}
+
+// testExpiringCluster returns a cluster with the ExpiresAtTagKey tag set to expires
+// after testPlanNow
+func testExpiringCluster(name string, age float64, expires time.Duration) Cluster {
+	cluster := testCluster(name, age)
+	cluster.ExpiresAt = testPlanNow.Add(expires)
+
+	return cluster
+}
+
+func TestPlanClustersExpiresAt(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name: "tagged cluster expired before OldestAge",
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testExpiringCluster("02", 1, -time.Minute),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"02"},
+			primary: "01",
+		},
+		{
+			name: "tagged cluster kept past OldestAge",
+			clusters: []Cluster{
+				testExpiringCluster("01", 45, time.Hour),
+				testCluster("02", 44),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			delete:  []string{"02"},
+			primary: "01",
+		},
+		{
+			name: "tagged cluster expires exactly now",
+			clusters: []Cluster{
+				testExpiringCluster("01", 1, 0),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "01",
+		},
+		{
+			name: "youngest cluster primary regardless of tag",
+			clusters: []Cluster{
+				testExpiringCluster("01", 5, time.Hour),
+				testCluster("02", 3),
+				testExpiringCluster("03", 1, time.Hour*3),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			delete:  []string{"01", "02"},
+			primary: "03",
+		},
+		{
+			name: "all expired",
+			clusters: []Cluster{
+				testExpiringCluster("01", 5, -time.Hour),
+				testCluster("02", 43),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			create:  []string{"new"},
+			delete:  []string{"02", "01"},
+			primary: "new",
+		},
+		{
+			name: "rotating primary",
+			clusters: []Cluster{
+				testExpiringCluster("01", 5, time.Hour),
+				testCluster("02", 3),
+				testExpiringCluster("03", 1, -time.Minute),
+			},
+			state:   PlanState{RecordsCluster: "02", RotatePrimary: true},
+			create:  []string{"new"},
+			delete:  []string{"01", "02", "03"},
+			primary: "new",
+		},
+	})
+}
+
+func TestPlanClustersDuplicateDeletes(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name: "too old and orphaned",
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 1),
+			},
+			orphans: []Cluster{
+				testCluster("01", 44),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "too old and without instances",
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 1),
+			},
+			state: PlanState{
+				RecordsCluster: "02",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-01": testCluster("01", 44),
+				},
+			},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "not youngest and orphaned",
+			clusters: []Cluster{
+				testCluster("01", 5),
+				testCluster("02", 1),
+			},
+			orphans: []Cluster{
+				testCluster("01", 5),
+			},
+			state: PlanState{
+				RecordsCluster: "02",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-01": testCluster("01", 5),
+				},
+			},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+	})
+}
+
+// writeTestFile writes a file, and its parent directories, in dir
+func writeTestFile(t *testing.T, dir, file, content string) {
+	path := filepath.Join(dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to make parent directories of %s: %s", file, err.Error())
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err.Error())
+	}
+}
+
+func TestFindInstancelessClusters(t *testing.T) {
+	cfg := Config{}
+	cfg.Cluster.NamePrefix = "auto-cluster-"
+	cfg.OpenShiftInstall.StateStorePath = tempDir(t)
+	defer os.RemoveAll(cfg.OpenShiftInstall.StateStorePath)
+
+	store := cfg.OpenShiftInstall.StateStorePath
+
+	// Never finished being created
+	writeTestFile(t, store, "auto-cluster-01/metadata.json",
+		`{"infraID": "auto-cluster-01-abcde"}`)
+
+	// Instances terminated
+	writeTestFile(t, store, "auto-cluster-02/metadata.json",
+		`{"infraID": "auto-cluster-02-fghij"}`)
+	writeTestFile(t, store, "auto-cluster-02/auth/kubeadmin-password", "password")
+
+	// Has discovered instances
+	writeTestFile(t, store, "auto-cluster-03/metadata.json",
+		`{"infraID": "auto-cluster-03-klmno"}`)
+
+	// Destroyed
+	writeTestFile(t, store, "auto-cluster-04/.openshift_install.log", "")
+
+	// Failed delete
+	writeTestFile(t, store, "auto-cluster-05/"+metadataBackupFile,
+		`{"infraID": "auto-cluster-05-pqrst"}`)
+
+	// Instances stopped
+	writeTestFile(t, store, "auto-cluster-06/metadata.json",
+		`{"infraID": "auto-cluster-06-abcde"}`)
+	writeTestFile(t, store, "auto-cluster-06/auth/kubeadmin-password", "password")
+
+	// Instances not discovered, ex., not managed
+	writeTestFile(t, store, "auto-cluster-07/metadata.json",
+		`{"infraID": "auto-cluster-07-fghij"}`)
+	writeTestFile(t, store, "auto-cluster-07/auth/kubeadmin-password", "password")
+
+	// Unknown infrastructure ID
+	writeTestFile(t, store, "auto-cluster-08/metadata.json", `{}`)
+
+	// Not managed
+	writeTestFile(t, store, "other-01/metadata.json", `{"infraID": "other-01-uvwxy"}`)
+
+	instanceStates := map[string][]string{
+		"auto-cluster-06-abcde": {"stopped", "stopping"},
+		"auto-cluster-07-fghij": {"running", "stopped"},
+	}
+
+	logs := &strings.Builder{}
+	instanceless, err := findInstancelessClusters(log.New(logs, "", 0), cfg,
+		map[string]Cluster{"auto-cluster-03": testCluster("03", 1)},
+		map[string]Cluster{}, time.Now(), func(infraID string) ([]string, error) {
+			return instanceStates[infraID], nil
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	names := []string{}
+	for name, cluster := range instanceless {
+		names = append(names, name)
+
+		if cluster.InfraID != map[string]string{
+			"auto-cluster-01": "auto-cluster-01-abcde",
+			"auto-cluster-02": "auto-cluster-02-fghij",
+			"auto-cluster-05": "auto-cluster-05-pqrst",
+		}[name] {
+			t.Errorf("cluster %s has infrastructure ID %s", name, cluster.InfraID)
+		}
+
+		if cluster.Age < 0 || cluster.Age > time.Minute {
+			t.Errorf("cluster %s has age %s", name, cluster.Age.String())
+		}
+	}
+	sort.Strings(names)
+
+	expected := []string{"auto-cluster-01", "auto-cluster-02", "auto-cluster-05"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v, expected %v", names, expected)
+	}
+
+	for _, line := range []string{
+		"cluster auto-cluster-01 has no instances, it never finished being " +
+			"created, will delete",
+		"cluster auto-cluster-02 has no instances, its instances were " +
+			"terminated, will delete",
+		"cluster auto-cluster-06 has no running instances, its instances were " +
+			"stopped, keeping since it can be restarted",
+		"cluster auto-cluster-07 has instances which are not managed",
+		"WARNING: not deleting cluster auto-cluster-08",
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("did not log \"%s\", logged:\n%s", line, logs.String())
+		}
+	}
+
+	// Clusters are not deleted if their instances cannot be described
+	_, err = findInstancelessClusters(log.New(ioutil.Discard, "", 0), cfg,
+		map[string]Cluster{}, map[string]Cluster{}, time.Now(),
+		func(infraID string) ([]string, error) {
+			return nil, fmt.Errorf("throttled")
+		})
+	if err == nil {
+		t.Error("expected an error when instances cannot be described")
+	}
+}
+
+// TestPlanClustersUndiscoveredInstances tests clusters which discovery leaves out
+// are not deleted as clusters without instances
+func TestPlanClustersUndiscoveredInstances(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		cfg      func(cfg *Config)
+		instance *ec2Svc.Instance
+	}{
+		{
+			name: "not managed with RequireManagedTag",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.RequireManagedTag = true
+			},
+			instance: testInstance("i-2", "running", now.Add(-time.Hour),
+				"Name", "auto-cluster-02-fghij-master-0",
+				ClusterOwnedTagPrefix+"auto-cluster-02-fghij", "owned"),
+		},
+		{
+			name: "not tagged with EnvironmentTag",
+			cfg: func(cfg *Config) {
+				cfg.Cluster.EnvironmentTag = "environment=staging"
+			},
+			instance: testInstance("i-2", "running", now.Add(-time.Hour),
+				"Name", "auto-cluster-02-fghij-master-0",
+				ClusterOwnedTagPrefix+"auto-cluster-02-fghij", "owned"),
+		},
+		{
+			name: "ignored and stopped",
+			instance: testInstance("i-2", "stopped", now.Add(-time.Hour),
+				"Name", "auto-cluster-02-fghij-master-0",
+				ClusterOwnedTagPrefix+"auto-cluster-02-fghij", "owned",
+				IgnoreTagKey, "true"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Cluster.NamePrefix = "auto-cluster-"
+			cfg.Cluster.OldestAge = 42
+			cfg.Cluster.MaxDeletes = 3
+			cfg.Health.UnhealthyLimit = 3
+			cfg.OpenShiftInstall.StateStorePath = tempDir(t)
+			defer os.RemoveAll(cfg.OpenShiftInstall.StateStorePath)
+			if test.cfg != nil {
+				test.cfg(&cfg)
+			}
+
+			for _, name := range []string{"01-abcde", "02-fghij"} {
+				writeTestFile(t, cfg.OpenShiftInstall.StateStorePath,
+					"auto-cluster-"+name[:2]+"/metadata.json",
+					fmt.Sprintf(`{"infraID": "auto-cluster-%s"}`, name))
+			}
+
+			// Discovery only finds cluster 01
+			instances := []*ec2Svc.Instance{
+				testInstance("i-1", "running", now.Add(-time.Hour),
+					"Name", "auto-cluster-01-abcde-master-0",
+					ClusterOwnedTagPrefix+"auto-cluster-01-abcde", "owned",
+					ManagedTagKey, "true", "environment", "staging"),
+				test.instance,
+			}
+
+			logger := log.New(ioutil.Discard, "", 0)
+			grouper := NewInstanceGrouper(logger, cfg, Flags{}, "auto-cluster-01",
+				func() time.Time { return now })
+			for _, instance := range instances {
+				grouper.Add(instance)
+			}
+
+			if _, ok := grouper.Clusters["auto-cluster-02"]; ok {
+				t.Fatal("cluster auto-cluster-02 was discovered")
+			}
+
+			// Instances are found by infrastructure ID without discovery's
+			// filters
+			instanceless, err := findInstancelessClusters(logger, cfg,
+				grouper.Clusters, map[string]Cluster{}, now,
+				func(infraID string) ([]string, error) {
+					states := []string{}
+					for _, instance := range instances {
+						if _, owner := ec2InstanceName(instance); owner == infraID {
+							states = append(states,
+								aws.StringValue(instance.State.Name))
+						}
+					}
+					return states, nil
+				})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			plan, _, _, err := planClusters(grouper.Clusters, map[string]Cluster{},
+				cfg, now, PlanState{
+					Logger:         logger,
+					Instanceless:   instanceless,
+					RecordsCluster: "auto-cluster-01",
+					NextName: func() (string, error) {
+						return "auto-cluster-new", nil
+					},
+				})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if len(plan.Delete) > 0 {
+				t.Errorf("planned to delete %v", clusterNames(plan.Delete))
+			}
+		})
+	}
+}
+
+func TestPlanClustersInstanceless(t *testing.T) {
+	runPlanTests(t, []planTest{
+		{
+			name: "never finished being created",
+			clusters: []Cluster{
+				testCluster("02", 1),
+			},
+			state: PlanState{
+				RecordsCluster: "02",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-03": {Name: "auto-cluster-03", Age: time.Minute},
+				},
+			},
+			delete:  []string{"03"},
+			primary: "02",
+		},
+		{
+			name: "instances terminated",
+			clusters: []Cluster{
+				testCluster("02", 1),
+			},
+			state: PlanState{
+				RecordsCluster: "01",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-01": {Name: "auto-cluster-01", Age: time.Hour * 5},
+				},
+			},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "no other clusters",
+			state: PlanState{
+				RecordsCluster: "01",
+				Instanceless: map[string]Cluster{
+					"auto-cluster-01": {Name: "auto-cluster-01", Age: time.Hour * 5},
+				},
+			},
+			create:  []string{"new"},
+			delete:  []string{"01"},
+			primary: "new",
+		},
+	})
+}
+
+func TestPlanClustersMinPrimaryAge(t *testing.T) {
+	minPrimaryAge := func(cfg *Config) {
+		cfg.Cluster.MinPrimaryAge = 2
+	}
+
+	runPlanTests(t, []planTest{
+		{
+			name: "too young cluster does not replace primary",
+			cfg:  minPrimaryAge,
+			clusters: []Cluster{
+				testCluster("01", 10),
+				testCluster("02", 0.5),
+			},
+			state:   PlanState{RecordsCluster: "01"},
+			primary: "01",
+		},
+		{
+			name: "too young cluster does not replace unhealthy primary",
+			cfg:  minPrimaryAge,
+			clusters: []Cluster{
+				testUnhealthyCluster("01", 10),
+				testCluster("02", 0.5),
+			},
+			state: PlanState{
+				RecordsCluster:  "01",
+				UnhealthyCounts: map[string]uint{"auto-cluster-01": 1},
+			},
+			primary: "01",
+		},
+		{
+			name: "only too young clusters",
+			cfg:  minPrimaryAge,
+			clusters: []Cluster{
+				testCluster("01", 0.5),
+				testCluster("02", 1),
+			},
+			state: PlanState{RecordsCluster: "02"},
+		},
+		{
+			name: "too young cluster keeps expired DNS cluster",
+			cfg:  minPrimaryAge,
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 0.5),
+			},
+			state: PlanState{RecordsCluster: "01"},
+		},
+		{
+			name: "too young cluster counted toward MinHealthy",
+			cfg: func(cfg *Config) {
+				minPrimaryAge(cfg)
+				cfg.Cluster.MinHealthy = 2
+			},
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 10),
+				testCluster("03", 0.5),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			delete:  []string{"01"},
+			primary: "02",
+		},
+		{
+			name: "too young unhealthy cluster not counted toward MinHealthy",
+			cfg: func(cfg *Config) {
+				minPrimaryAge(cfg)
+				cfg.Cluster.MinHealthy = 2
+				cfg.Health.Probe = true
+			},
+			clusters: []Cluster{
+				testCluster("01", 44),
+				testCluster("02", 10),
+				testUnhealthyCluster("03", 0.5),
+			},
+			state:   PlanState{RecordsCluster: "02"},
+			primary: "02",
+		},
+	})
+}
+
+func TestRunCmd(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		idleTimeout time.Duration
+		timeout     time.Duration
+		err         string
+	}{
+		{
+			name:   "succeeds",
+			script: "echo stdout; echo stderr >&2",
+		},
+		{
+			name:   "fails",
+			script: "exit 3",
+			err:    "failed to wait for command to complete: exit status 3",
+		},
+		{
+			name:    "times out",
+			script:  "echo start; sleep 10",
+			timeout: time.Millisecond * 200,
+			err:     "command timed out after 200ms",
+		},
+		{
+			name:    "times out with children",
+			script:  "sleep 10 & sleep 10",
+			timeout: time.Millisecond * 200,
+			err:     "command timed out after 200ms",
+		},
+		{
+			name:        "stalls",
+			script:      "echo start; sleep 10",
+			idleTimeout: time.Millisecond * 200,
+			err:         "command stalled, no output for 200ms",
+		},
+		{
+			name:        "output resets idle timeout",
+			script:      "for i in 1 2 3 4 5; do echo $i; sleep 0.1; done",
+			idleTimeout: time.Millisecond * 500,
+		},
+		{
+			name:        "finishes before timeouts",
+			script:      "echo done",
+			idleTimeout: time.Second * 5,
+			timeout:     time.Second * 5,
+		},
+		{
+			name: "output cannot be read",
+			// Lines longer than bufio.MaxScanTokenSize cannot be scanned, the
+			// output after it must still be drained or the command would block
+			script: "head -c 100000 /dev/zero | tr '\\0' a; echo; " +
+				"head -c 1000000 /dev/zero | tr '\\0' '\\n'",
+			timeout: time.Second * 10,
+			err: "command completed but its output could not be read: failed to " +
+				"read stdout: bufio.Scanner: token too long",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := log.New(ioutil.Discard, "", 0)
+			err := runCmd(logger, logger, exec.Command("sh", "-c", test.script),
+				test.idleTimeout, test.timeout)
+
+			if len(test.err) == 0 && err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			} else if len(test.err) > 0 && (err == nil || err.Error() != test.err) {
+				t.Fatalf("got error %v, expected \"%s\"", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidClusterName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "auto-cluster-01", valid: true},
+		{name: "a", valid: true},
+		{name: strings.Repeat("a", 63), valid: true},
+		{name: strings.Repeat("a", 64)},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "../auto-cluster-01"},
+		{name: "a/b"},
+		{name: "/a"},
+		{name: "-a"},
+		{name: "a-"},
+		{name: "Auto-Cluster-01"},
+		{name: "auto_cluster"},
+		{name: "a b"},
+	}
+
+	for _, test := range tests {
+		err := validClusterName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("\"%s\" is valid, got error: %s", test.name, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("\"%s\" is invalid, got no error", test.name)
+		}
+	}
+}
+
+// filterStrings returns filters as "name=value,value" strings
+func filterStrings(filters []*ec2Svc.Filter) []string {
+	strs := []string{}
+	for _, filter := range filters {
+		strs = append(strs, fmt.Sprintf("%s=%s", aws.StringValue(filter.Name),
+			strings.Join(aws.StringValueSlice(filter.Values), ",")))
+	}
+
+	return strs
+}
+
+func TestEC2InstanceFilters(t *testing.T) {
+	tests := []struct {
+		name              string
+		namePrefix        string
+		requireManagedTag bool
+		environmentTag    string
+		reapOrphans       bool
+		filters           [][]string
+	}{
+		{
+			name:       "name prefix",
+			namePrefix: "auto-cluster-",
+			filters: [][]string{
+				{
+					"tag:Name=auto-cluster-*",
+					"instance-state-name=pending,running",
+				},
+				{
+					"tag-key=kubernetes.io/cluster/auto-cluster-*",
+					"instance-state-name=pending,running",
+				},
+			},
+		},
+		{
+			name:       "other name prefix",
+			namePrefix: "staging-",
+			filters: [][]string{
+				{
+					"tag:Name=staging-*",
+					"instance-state-name=pending,running",
+				},
+				{
+					"tag-key=kubernetes.io/cluster/staging-*",
+					"instance-state-name=pending,running",
+				},
+			},
+		},
+		{
+			name:              "name prefix and RequireManagedTag",
+			namePrefix:        "auto-cluster-",
+			requireManagedTag: true,
+			filters: [][]string{
+				{
+					"tag:Name=auto-cluster-*",
+					"instance-state-name=pending,running",
+					"tag:auto-cluster/managed=true",
+				},
+				{
+					"tag-key=kubernetes.io/cluster/auto-cluster-*",
+					"instance-state-name=pending,running",
+					"tag:auto-cluster/managed=true",
+				},
+			},
+		},
+		{
+			name:              "RequireManagedTag and EnvironmentTag",
+			namePrefix:        "auto-cluster-",
+			requireManagedTag: true,
+			environmentTag:    "environment=staging",
+			filters: [][]string{
+				{
+					"tag:Name=auto-cluster-*",
+					"instance-state-name=pending,running",
+					"tag:auto-cluster/managed=true",
+					"tag:environment=staging",
+				},
+				{
+					"tag-key=kubernetes.io/cluster/auto-cluster-*",
+					"instance-state-name=pending,running",
+					"tag:auto-cluster/managed=true",
+					"tag:environment=staging",
+				},
+			},
+		},
+		{
+			name:        "orphans ignore name prefix",
+			namePrefix:  "auto-cluster-",
+			reapOrphans: true,
+			filters: [][]string{
+				{
+					"instance-state-name=pending,running",
+				},
+			},
+		},
+		{
+			name:              "orphans and RequireManagedTag",
+			namePrefix:        "auto-cluster-",
+			requireManagedTag: true,
+			reapOrphans:       true,
+			filters: [][]string{
+				{
+					"instance-state-name=pending,running",
+					"tag:auto-cluster/managed=true",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Cluster.NamePrefix = test.namePrefix
+			cfg.Cluster.RequireManagedTag = test.requireManagedTag
+			cfg.Cluster.EnvironmentTag = test.environmentTag
+
+			filters := [][]string{}
+			for _, set := range ec2InstanceFilters(cfg, Flags{
+				ReapOrphans: test.reapOrphans,
+			}) {
+				filters = append(filters, filterStrings(set))
+			}
+
+			if !reflect.DeepEqual(filters, test.filters) {
+				t.Errorf("got %v, expected %v", filters, test.filters)
+			}
+		})
+	}
+}
+
+func TestNormalizeConfig(t *testing.T) {
+	tests := []struct {
+		namePrefix string
+		expected   string
+		changes    int
+	}{
+		{namePrefix: "auto-cluster-", expected: "auto-cluster-"},
+		{namePrefix: "Auto-Cluster-", expected: "auto-cluster-", changes: 1},
+		{namePrefix: "AUTO-cluster-01-", expected: "auto-cluster-01-", changes: 1},
+		{namePrefix: "", expected: ""},
+	}
+
+	for _, test := range tests {
+		cfg := Config{}
+		cfg.Cluster.NamePrefix = test.namePrefix
+		cfg.Cluster.OldestAge = 42
+
+		changes := normalizeConfig(&cfg)
+
+		if cfg.Cluster.NamePrefix != test.expected {
+			t.Errorf("\"%s\": got \"%s\", expected \"%s\"", test.namePrefix,
+				cfg.Cluster.NamePrefix, test.expected)
+		}
+
+		if len(changes) != test.changes {
+			t.Errorf("\"%s\": got changes %v, expected %d", test.namePrefix, changes,
+				test.changes)
+		}
+
+		// Other values are not changed
+		if cfg.Cluster.OldestAge != 42 {
+			t.Errorf("\"%s\": Cluster.OldestAge changed to %f", test.namePrefix,
+				cfg.Cluster.OldestAge)
+		}
+	}
+}
+
+func TestConfigDefaultsAndUnits(t *testing.T) {
+	cfgType := reflect.TypeOf(Config{})
+
+	for i := 0; i < cfgType.NumField(); i++ {
+		section := cfgType.Field(i)
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			name := section.Name + "." + field.Name
+
+			if unit, ok := field.Tag.Lookup("unit"); ok {
+				if _, ok := durationUnits[unit]; !ok {
+					t.Errorf("%s has unknown unit \"%s\"", name, unit)
+				}
+
+				if field.Type.Kind() != reflect.Float64 {
+					t.Errorf("%s has a unit but is a %s, not a float64", name,
+						field.Type.String())
+				}
+			}
+
+			def, ok := field.Tag.Lookup("default")
+			if !ok {
+				continue
+			}
+
+			var err error
+			switch field.Type.Kind() {
+			case reflect.Bool:
+				_, err = strconv.ParseBool(def)
+			case reflect.Float64:
+				_, err = strconv.ParseFloat(def, 64)
+			case reflect.Int:
+				_, err = strconv.ParseInt(def, 10, 64)
+			case reflect.Uint:
+				_, err = strconv.ParseUint(def, 10, 64)
+			}
+			if err != nil {
+				t.Errorf("%s default \"%s\" is not a %s: %s", name, def,
+					field.Type.String(), err.Error())
+			}
+		}
+	}
+}
+
+func TestWriteEffectiveConfigUnits(t *testing.T) {
+	cfg := Config{}
+	cfg.Cluster.OldestAge = 42
+	cfg.Cluster.DeleteBackoff = 1.5
+	cfg.Status.StaleAge = 90
+
+	out := &strings.Builder{}
+	if err := writeEffectiveConfig(out, cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for _, line := range []string{
+		"OldestAge: 42\n",
+		"OldestAgeDuration: 42h0m0s\n",
+		"DeleteBackoffDuration: 1.5s\n",
+		"StaleAgeDuration: 1h30m0s\n",
+		"MinPrimaryAgeDuration: 0s\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("does not contain \"%s\":\n%s", strings.TrimSpace(line),
+				out.String())
+		}
+	}
+}
+
+func TestInstanceGrouperManyPages(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	cfg := Config{}
+	cfg.Cluster.NamePrefix = "auto-cluster-"
+	cfg.OpenShiftInstall.StateStorePath = tempDir(t)
+	defer os.RemoveAll(cfg.OpenShiftInstall.StateStorePath)
+
+	grouper := NewInstanceGrouper(log.New(ioutil.Discard, "", 0), cfg, Flags{},
+		"", func() time.Time { return now })
+
+	// 50 pages of 20 instances, each cluster's instances are spread over pages
+	for page := 0; page < 50; page++ {
+		for i := 0; i < 20; i++ {
+			cluster := (page*20 + i) % 10
+			grouper.Add(testInstance(fmt.Sprintf("i-%d-%d", page, i), "running",
+				now.Add(-time.Hour), "Name", fmt.Sprintf(
+					"auto-cluster-%02d-abcde-worker-%d-%d", cluster, page, i)))
+		}
+	}
+
+	if len(grouper.Clusters) != 10 {
+		t.Fatalf("got %d clusters, expected 10", len(grouper.Clusters))
+	}
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("auto-cluster-%02d", i)
+		cluster, ok := grouper.Clusters[name]
+		if !ok {
+			t.Errorf("cluster %s not found", name)
+			continue
+		}
+
+		if cluster.InfraID != name+"-abcde" || !cluster.Running {
+			t.Errorf("cluster %s grouped incorrectly: %s", name, cluster.String())
+		}
+	}
+}
+
+func TestUniqueClusters(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters []string
+		expected []string
+	}{
+		{
+			name:     "empty",
+			clusters: []string{},
+			expected: []string{},
+		},
+		{
+			name:     "no duplicates",
+			clusters: []string{"03", "01", "02"},
+			expected: []string{"03", "01", "02"},
+		},
+		{
+			name:     "duplicates",
+			clusters: []string{"03", "01", "03", "02", "01", "03"},
+			expected: []string{"03", "01", "02"},
+		},
+		{
+			name:     "all duplicates",
+			clusters: []string{"01", "01", "01"},
+			expected: []string{"01"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusters := []Cluster{}
+			for i, name := range test.clusters {
+				// Ages differ so the first of each name can be told apart
+				clusters = append(clusters, testCluster(name, float64(i)))
+			}
+
+			unique := uniqueClusters(clusters)
+
+			if names := clusterNames(unique); !reflect.DeepEqual(names,
+				test.expected) {
+				t.Fatalf("got %v, expected %v", names, test.expected)
+			}
+
+			// The first cluster with each name is kept
+			for _, cluster := range unique {
+				for i, name := range test.clusters {
+					if "auto-cluster-"+name == cluster.Name {
+						if cluster.Age != time.Duration(float64(i)*
+							float64(time.Hour)) {
+							t.Errorf("kept cluster %s with age %s, not the first",
+								cluster.Name, cluster.Age.String())
+						}
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// readOnlyDir makes a temporary directory which cannot be written to, the caller
+// must remove it. The test is skipped if the user can write to it anyway, ex., root
+func readOnlyDir(t *testing.T) string {
+	dir := tempDir(t)
+	if err := os.Chmod(dir, 0555); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to make directory read only: %s", err.Error())
+	}
+
+	if f, err := ioutil.TempFile(dir, ""); err == nil {
+		f.Close()
+		os.RemoveAll(dir)
+		t.Skip("read only directory can be written to, running as root?")
+	}
+
+	return dir
+}
+
+func TestPrepareStateStore(t *testing.T) {
+	t.Run("created", func(t *testing.T) {
+		parent := tempDir(t)
+		defer os.RemoveAll(parent)
+
+		dir := filepath.Join(parent, "state", "store")
+		if err := prepareStateStore(dir); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Fatalf("directory not created: %v", err)
+		}
+	})
+
+	t.Run("already exists", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		writeTestFile(t, dir, "auto-cluster-01/metadata.json", "{}")
+
+		if err := prepareStateStore(dir); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+
+		// Only existing files are left
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read directory: %s", err.Error())
+		}
+		if len(files) != 1 || files[0].Name() != "auto-cluster-01" {
+			t.Errorf("write test file left behind: %v", files)
+		}
+	})
+
+	t.Run("cannot be created", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		writeTestFile(t, dir, "file", "")
+
+		err := prepareStateStore(filepath.Join(dir, "file", "store"))
+		if err == nil || !strings.HasPrefix(err.Error(),
+			"failed to create directory: ") {
+			t.Fatalf("got error %v, expected failed to create directory", err)
+		}
+	})
+
+	t.Run("unwritable", func(t *testing.T) {
+		dir := readOnlyDir(t)
+		defer os.RemoveAll(dir)
+
+		err := prepareStateStore(dir)
+		if err == nil || !strings.HasPrefix(err.Error(),
+			"directory is not writable: ") {
+			t.Fatalf("got error %v, expected directory is not writable", err)
+		}
+	})
+}
+
+func TestCheckConfigReadOnlyStateStore(t *testing.T) {
+	dir := readOnlyDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.OpenShiftInstall.StateStorePath = dir
+
+	err := checkConfig(cfg)
+	expected := fmt.Sprintf("failed to prepare OpenShiftInstall.StateStorePath %s: "+
+		"directory is not writable: ", dir)
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Fatalf("got error %v, expected \"%s...\"", err, expected)
+	}
+}
+
+func TestWriteExampleConfig(t *testing.T) {
+	// Every section and field is documented, and every doc is of a field
+	docs := map[string]bool{}
+	for key := range configDocs {
+		docs[key] = true
+	}
+
+	cfgType := reflect.TypeOf(Config{})
+	for i := 0; i < cfgType.NumField(); i++ {
+		section := cfgType.Field(i)
+		keys := []string{section.Name}
+		for j := 0; j < section.Type.NumField(); j++ {
+			keys = append(keys, section.Name+"."+section.Type.Field(j).Name)
+		}
+
+		for _, key := range keys {
+			if !docs[key] {
+				t.Errorf("%s is not in configDocs", key)
+			}
+			delete(docs, key)
+		}
+	}
+
+	for key := range docs {
+		t.Errorf("configDocs has %s which is not a Config section or field", key)
+	}
+
+	// Docs are written above their fields
+	buf := &strings.Builder{}
+	if err := writeExampleConfig(buf); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := "# Age after which a cluster is replaced and deleted\n" +
+		"# float64 (hours), optional, must be: min=0,max=48\n" +
+		"OldestAge = 42\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("example configuration does not contain \"%s\": %s", expected,
+			buf.String())
+	}
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if len(line) > 80 {
+			t.Errorf("line longer than 80 characters: \"%s\"", line)
+		}
+	}
+}
+
+func TestRestartChanges(t *testing.T) {
+	current := Config{}
+	current.Cluster.NamePrefix = "auto-cluster-"
+	current.AWS.Endpoint = "http://localhost:4566"
+	current.Status.Addr = ":8080"
+
+	reloaded := current
+	reloaded.Cluster.NamePrefix = "other-"
+	reloaded.AWS.ThrottleMaxWait = 60
+	if changes := restartChanges(current, reloaded); len(changes) != 0 {
+		t.Errorf("got changes %v for fields used after startup", changes)
+	}
+
+	reloaded.AWS.Endpoint = ""
+	reloaded.Status.Addr = ":9090"
+	reloaded.Status.Pprof = true
+	expected := []string{"AWS.Endpoint", "Status.Addr", "Status.Pprof"}
+	if changes := restartChanges(current, reloaded); !reflect.DeepEqual(changes,
+		expected) {
+
+		t.Errorf("got changes %v, expected %v", changes, expected)
+	}
+}
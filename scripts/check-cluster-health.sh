@@ -0,0 +1,62 @@
+#!/usr/bin/env bash
+# check-cluster-health.sh - Checks if a cluster's API is reachable and its nodes are ready
+#
+# USAGE
+#
+#    check-cluster-health.sh -s STATE_DIR -n NAME
+#
+# OPTIONS
+#
+#    -s STATE_DIR    State directory
+#    -n NAME         Name of cluster to check
+#
+# BEHAVIOR
+#
+#    Exits with a non-zero status if the cluster is not healthy.
+#?
+
+# Helpers
+function die() {
+    echo "Error: $@" >&2
+    exit 1
+}
+
+# Options
+while getopts "s:n:" opt; do
+    case "$opt" in
+	s) state_dir="$OPTARG" ;;
+	n) name="$OPTARG" ;;
+	?) die "Unknown option" ;;
+    esac
+done
+
+if [ -z "$state_dir" ]; then
+    die "-s STATE_DIR option required"
+fi
+
+if [ -z "$name" ]; then
+    die "-n NAME option required"
+fi
+
+export KUBECONFIG="$state_dir/$name/auth/kubeconfig"
+
+if [ ! -f "$KUBECONFIG" ]; then
+    die "kubeconfig for $name cluster does not exist"
+fi
+
+# Check API
+if ! oc get --raw /healthz &> /dev/null; then
+    die "Kubernetes API of $name cluster is not reachable"
+fi
+
+# Check nodes
+if ! nodes=$(oc get nodes -o jsonpath='{range .items[*]}{.metadata.name}{" "}{.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}'); then
+    die "Failed to get nodes of $name cluster"
+fi
+
+not_ready=$(echo "$nodes" | grep -v ' True$' | grep -v '^$')
+if [ -n "$not_ready" ]; then
+    die "Nodes not ready in $name cluster: $(echo $not_ready | tr '\n' ' ')"
+fi
+
+echo "$name cluster is healthy"
@@ -18,6 +18,26 @@
 #    Environment variables are used to configure the script:
 #
 #    AUTO_CLUSTER_PULL_SECRET_PATH    Path to pull-secret file
+#    AUTO_CLUSTER_ZONES               Comma separated AWS availability zones in
+#                                     which to create machines, optional
+#    AUTO_CLUSTER_SUBNETS             Comma separated IDs of existing subnets 
+#                                     in which to create clusters, optional
+#    AUTO_CLUSTER_PUBLISH             How the API and ingress are published: 
+#                                     External or Internal, optional
+#    AUTO_CLUSTER_USER_TAGS           Comma separated KEY=VALUE tags to add to
+#                                     AWS resources, optional
+#    AUTO_CLUSTER_HTTP_PROXY          Proxy URL for HTTP requests, optional
+#    AUTO_CLUSTER_HTTPS_PROXY         Proxy URL for HTTPS requests, optional
+#    AUTO_CLUSTER_NO_PROXY            Comma separated domains and CIDRs which 
+#                                     will not be proxied, optional
+#    AUTO_CLUSTER_CREDENTIALS_MODE    How cluster components get AWS 
+#                                     credentials: Mint, Passthrough, or 
+#                                     Manual, optional
+#    AUTO_CLUSTER_FEATURE_SET         Feature set to enable, ex., 
+#                                     TechPreviewNoUpgrade, optional
+#    AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH
+#                                     Path to file with PEM encoded certificates
+#                                     which clusters will trust, optional
 #
 #?
 
@@ -38,6 +58,85 @@ if [ ! -f "$AUTO_CLUSTER_PULL_SECRET_PATH" ]; then
     die "$AUTO_CLUSTER_PULL_SECRET_PATH file not found"
 fi
 
+platform_aws_extra=""
+if [ -n "$AUTO_CLUSTER_ZONES" ]; then
+    platform_aws_extra+="
+    defaultMachinePlatform:
+      zones:"
+    for zone in $(echo "$AUTO_CLUSTER_ZONES" | tr ',' ' '); do
+	   platform_aws_extra+="
+      - $zone"
+    done
+fi
+
+if [ -n "$AUTO_CLUSTER_SUBNETS" ]; then
+    platform_aws_extra+="
+    subnets:"
+    for subnet in $(echo "$AUTO_CLUSTER_SUBNETS" | tr ',' ' '); do
+	   platform_aws_extra+="
+    - $subnet"
+    done
+fi
+
+if [ -n "$AUTO_CLUSTER_USER_TAGS" ]; then
+    platform_aws_extra+="
+    userTags:"
+    IFS=',' read -ra user_tags <<< "$AUTO_CLUSTER_USER_TAGS"
+    for tag in "${user_tags[@]}"; do
+	   platform_aws_extra+="
+      \"${tag%%=*}\": \"${tag#*=}\""
+    done
+fi
+
+extra=""
+if [ -n "$AUTO_CLUSTER_HTTP_PROXY" ] || [ -n "$AUTO_CLUSTER_HTTPS_PROXY" ] || [ -n "$AUTO_CLUSTER_NO_PROXY" ]; then
+    extra+="
+proxy:"
+
+    if [ -n "$AUTO_CLUSTER_HTTP_PROXY" ]; then
+	   extra+="
+  httpProxy: \"$AUTO_CLUSTER_HTTP_PROXY\""
+    fi
+
+    if [ -n "$AUTO_CLUSTER_HTTPS_PROXY" ]; then
+	   extra+="
+  httpsProxy: \"$AUTO_CLUSTER_HTTPS_PROXY\""
+    fi
+
+    if [ -n "$AUTO_CLUSTER_NO_PROXY" ]; then
+	   extra+="
+  noProxy: \"$AUTO_CLUSTER_NO_PROXY\""
+    fi
+fi
+
+if [ -n "$AUTO_CLUSTER_PUBLISH" ]; then
+    extra+="
+publish: $AUTO_CLUSTER_PUBLISH"
+fi
+
+if [ -n "$AUTO_CLUSTER_CREDENTIALS_MODE" ]; then
+    extra+="
+credentialsMode: $AUTO_CLUSTER_CREDENTIALS_MODE"
+fi
+
+if [ -n "$AUTO_CLUSTER_FEATURE_SET" ]; then
+    extra+="
+featureSet: $AUTO_CLUSTER_FEATURE_SET"
+fi
+
+if [ -n "$AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH" ]; then
+    if [ ! -f "$AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH" ]; then
+	   die "$AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH file not found"
+    fi
+
+    extra+="
+additionalTrustBundle: |"
+    while IFS= read -r line; do
+	   extra+="
+  $line"
+    done < "$AUTO_CLUSTER_ADDITIONAL_TRUST_BUNDLE_PATH"
+fi
+
 cat <<EOF
 apiVersion: v1
 baseDomain: devcluster.openshift.com
@@ -64,6 +163,6 @@ networking:
   - 172.30.0.0/16
 platform:
   aws:
-    region: us-east-1
-pullSecret: '$(cat $AUTO_CLUSTER_PULL_SECRET_PATH)'
+    region: us-east-1$platform_aws_extra
+pullSecret: '$(cat $AUTO_CLUSTER_PULL_SECRET_PATH)'$extra
 EOF
@@ -3,13 +3,25 @@
 #
 # USAGE
 #
-#    run-openshift-install.sh -s STATE_DIR -a ACTION -n NAME
+#    run-openshift-install.sh -s STATE_DIR -a ACTION -n NAME [-l LOG_LEVEL]
+#        [-c INSTALL_CONFIG] [-w WORK_DIR]
 #
 # OPTIONS
 #
 #    -s STATE_DIR    State directory
-#    -a ACTION       Action to perform, must be one of "create" or "delete"
+#    -a ACTION       Action to perform, must be one of "create", "delete", or
+#                    "gather" to collect bootstrap logs of a failed create
 #    -n NAME         Cluster name to perform action on
+#    -l LOG_LEVEL    openshift-install log level, one of "debug", "info", 
+#                    "warn", or "error", defaults to "info"
+#    -c INSTALL_CONFIG
+#                    openshift-install configuration file to use when the
+#                    action is "create", if not provided one is generated
+#    -w WORK_DIR     Directory in which to run openshift-install when the action
+#                    is "create" or "gather". Only the files needed to access
+#                    and delete the cluster are copied to STATE_DIR. Removed
+#                    after a successful create. If not provided STATE_DIR is
+#                    used.
 #
 #?
 
@@ -26,11 +38,14 @@ function bold() {
 }
 
 # Options
-while getopts "s:a:n:" opt; do
+while getopts "s:a:n:l:c:w:" opt; do
     case "$opt" in
 	s) state_dir="$OPTARG" ;;
 	a) action="$OPTARG" ;;
 	n) name="$OPTARG" ;;
+	l) log_level="$OPTARG" ;;
+	c) install_config="$OPTARG" ;;
+	w) work_dir="$OPTARG" ;;
 	?) die "Unknown option"
     esac
 done
@@ -47,14 +62,26 @@ if [ -z "$action" ]; then
     die "-a ACTION option required"
 fi
 
-if [[ ! "$action" =~ ^create|delete$ ]]; then
-    die "-a ACTION must be \"create\" or \"delete\""
+if [[ ! "$action" =~ ^(create|delete|gather)$ ]]; then
+    die "-a ACTION must be \"create\", \"delete\", or \"gather\""
 fi
 
 if [ -z "$name" ]; then
     die "-n NAME option required"
 fi
 
+if [ -n "$work_dir" ] && [ ! -d "$work_dir" ]; then
+    die "-w WORK_DIR directory does not exist"
+fi
+
+if [ -z "$log_level" ]; then
+    log_level="info"
+fi
+
+if [[ ! "$log_level" =~ ^(debug|info|warn|error)$ ]]; then
+    die "-l LOG_LEVEL must be \"debug\", \"info\", \"warn\", or \"error\""
+fi
+
 # Ensure we have all the bins we need
 for prog in openshift-install; do
     if ! which "$prog" &> /dev/null; then
@@ -66,27 +93,58 @@ done
 cd "$state_dir"
 cluster_d="$state_dir/$name"
 
+# Directory openshift-install runs in
+install_d="$cluster_d"
+if [ -n "$work_dir" ]; then
+    install_d="$work_dir/$name"
+fi
+
+# Copies the files needed to access and delete the cluster from the work
+# directory to the state directory
+function copy_state() {
+    if [ "$install_d" == "$cluster_d" ]; then
+	return
+    fi
+
+    for f in metadata.json auth .openshift_install.log; do
+	if [ -e "$install_d/$f" ] && ! cp -r "$install_d/$f" "$cluster_d/"; then
+	    die "Failed to copy $f to cluster directory"
+	fi
+    done
+}
+
 case "$action" in
     create)
 	bold "Creating $name"
 	
 	# Create install configuration
-	if ! mkdir -p "$cluster_d"; then
+	if ! mkdir -p "$cluster_d" "$install_d"; then
 	    die "Failed to make cluster directory"
 	fi
 	
-	config_f="$cluster_d/install-config.yaml"
+	config_f="$install_d/install-config.yaml"
 	
-	if ! "$prog_dir/openshift-install-create-config.yaml.sh" "$name" > "$config_f"; then
+	if [ -n "$install_config" ]; then
+	    if ! cp "$install_config" "$config_f"; then
+		die "Failed to copy openshift-install configuration file"
+	    fi
+	elif ! "$prog_dir/openshift-install-create-config.yaml.sh" "$name" > "$config_f"; then
 	    die "Failed to create openshift-install configuration file"
 	fi
 
 	echo "Created openshift-install configuration"
 	
-	if ! openshift-install create cluster --dir "$cluster_d"; then
+	if ! openshift-install create cluster --dir "$install_d" --log-level "$log_level"; then
+	    copy_state
 	    die "Failed to create cluster $name"
 	fi
 
+	copy_state
+
+	if [ "$install_d" != "$cluster_d" ] && ! rm -rf "$install_d"; then
+	    die "Failed to remove work directory"
+	fi
+
 	echo "Created $name"
 	;;
     delete)
@@ -96,11 +154,32 @@ case "$action" in
 	    die "Cluster directory does not exist"
 	fi
 
-	if ! openshift-install destroy cluster --dir "$cluster_d"; then
+	if ! openshift-install destroy cluster --dir "$cluster_d" --log-level "$log_level"; then
 	    die "Failed to delete cluster $name"
 	fi
 
 	echo "Deleted $name"
 	;;
+    gather)
+	bold "Gathering bootstrap logs of $name"
+
+	if [ ! -d "$install_d" ]; then
+	    die "Cluster directory does not exist"
+	fi
+
+	if ! openshift-install gather bootstrap --dir "$install_d" --log-level "$log_level"; then
+	    die "Failed to gather bootstrap logs of $name"
+	fi
+
+	if [ "$install_d" != "$cluster_d" ]; then
+	    for f in "$install_d"/log-bundle-*.tar.gz; do
+		if [ -f "$f" ] && ! cp "$f" "$cluster_d/"; then
+		    die "Failed to copy log bundle to cluster directory"
+		fi
+	    done
+	fi
+
+	echo "Gathered bootstrap logs of $name"
+	;;
 esac
 